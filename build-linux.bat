@@ -7,7 +7,7 @@ REM 编译 Linux 版本
 set GOOS=linux
 set GOARCH=amd64
 cd src
-go build -o ../ics-dp-linux main.go webshell.go csmp.go vncAddress.go vnc.go device.go
+go build -o ../ics-dp-linux .
 cd ..
 set GOOS=
 set GOARCH=
\ No newline at end of file
@@ -4,5 +4,5 @@ REM 开发运行脚本 - ics-dp
 REM =====================================
 
 cd src
-go build -o ../ics-dp.exe main.go webshell.go csmp.go vncAddress.go vnc.go device.go
+go build -o ../ics-dp.exe .
 cd ..
\ No newline at end of file
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计操作类型
+const (
+	AuditLogin              = "auth.login"
+	AuditLogout             = "auth.logout"
+	AuditMFAFailure         = "auth.mfa_failure"
+	AuditDeviceCreate       = "device.create"
+	AuditDeviceUpdate       = "device.update"
+	AuditDeviceDelete       = "device.delete"
+	AuditWebShellConnect    = "webshell.connect"
+	AuditWebShellDisconnect = "webshell.disconnect"
+	AuditWebShellShare      = "webshell.share"
+	AuditWebShellAttach     = "webshell.attach"
+	AuditWebShellRevoke     = "webshell.revoke"
+	AuditWebShellDetach     = "webshell.detach"
+	AuditWebShellResume     = "webshell.resume"
+	AuditVNCConnect         = "vnc.connect"
+	AuditVNCDisconnect      = "vnc.disconnect"
+	AuditVMRefresh          = "vm.refresh"
+	AuditAccessDenied       = "access.denied"
+	AuditHostKeyMismatch    = "hostkey.mismatch"
+	AuditHostKeyAccept      = "hostkey.accept"
+	AuditHostKeyReset       = "hostkey.reset"
+	AuditRecordingView      = "recording.view"
+	AuditSFTPDownload       = "sftp.download"
+	AuditSFTPUpload         = "sftp.upload"
+	AuditSFTPMkdir          = "sftp.mkdir"
+	AuditSFTPRename         = "sftp.rename"
+	AuditSFTPDelete         = "sftp.delete"
+	AuditSFTPChmod          = "sftp.chmod"
+	AuditJobRun             = "job.run"
+	AuditJobHost            = "job.host"
+	AuditJobCancel          = "job.cancel"
+	AuditRunbookCreate      = "runbook.create"
+	AuditRunbookUpdate      = "runbook.update"
+	AuditRunbookDelete      = "runbook.delete"
+	AuditScheduleCreate     = "schedule.create"
+	AuditScheduleUpdate     = "schedule.update"
+	AuditScheduleDelete     = "schedule.delete"
+	AuditScheduleRun        = "schedule.run"
+	AuditForwardCreate      = "forward.create"
+	AuditForwardConnect     = "forward.connect"
+	AuditForwardClose       = "forward.close"
+)
+
+// 审计结果
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// 审计记录，每条记录包含上一条记录的哈希，构成哈希链
+type AuditEntry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	ActorID  int       `json:"actor_id,omitempty"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	Action   string    `json:"action"`
+	DeviceID int       `json:"device_id,omitempty"`
+	VM       string    `json:"vm,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// 计算记录哈希：对不含 hash 字段的 JSON 做 SHA-256
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// 只追加的审计日志，每行一条 JSON 记录
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// 全局审计日志，在 main 中初始化
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	// 打开时校验已有记录，并接着最后一条记录的序号和哈希继续写；哈希链已损坏时拒绝启动
+	last, err := verifyAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("审计日志校验失败: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: f, seq: last.Seq, lastHash: last.Hash}, nil
+}
+
+func (l *auditLog) Append(e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.PrevHash = l.lastHash
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = e.Seq
+	l.lastHash = e.Hash
+	return nil
+}
+
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// 审计查询条件，零值表示不限制
+type auditFilter struct {
+	From     time.Time
+	To       time.Time
+	Actor    string
+	DeviceID int
+	Action   string
+	Limit    int
+}
+
+func (f auditFilter) match(e AuditEntry) bool {
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	if f.Actor != "" && !strings.EqualFold(f.Actor, e.Actor) {
+		return false
+	}
+	if f.DeviceID != 0 && f.DeviceID != e.DeviceID {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	return true
+}
+
+// 按条件查询，最新的记录在前，最多返回 Limit 条
+func (l *auditLog) Query(f auditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matched []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("第 %d 行格式错误: %v", line, err)
+		}
+		if f.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []AuditEntry{}
+	for i := len(matched) - 1; i >= 0 && len(result) < f.Limit; i-- {
+		result = append(result, matched[i])
+	}
+	return result, nil
+}
+
+// 校验审计日志的哈希链，返回最后一条记录；日志为空时返回零值
+func verifyAuditLog(path string) (AuditEntry, error) {
+	var last AuditEntry
+	file, err := os.Open(path)
+	if err != nil {
+		return last, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return last, fmt.Errorf("第 %d 行格式错误: %v", line, err)
+		}
+		if e.Seq != last.Seq+1 {
+			return last, fmt.Errorf("第 %d 行序号不连续: 期望 %d，实际 %d", line, last.Seq+1, e.Seq)
+		}
+		if e.PrevHash != last.Hash {
+			return last, fmt.Errorf("第 %d 行（序号 %d）与上一条记录的哈希不匹配", line, e.Seq)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return last, err
+		}
+		if hash != e.Hash {
+			return last, fmt.Errorf("第 %d 行（序号 %d）内容被修改", line, e.Seq)
+		}
+		last = e
+	}
+	return last, scanner.Err()
+}
+
+// 记录一条审计日志，写入失败只打印日志，不影响请求
+func recordAudit(c *gin.Context, action string, deviceID int, vm, outcome, detail string) {
+	if audit == nil {
+		return
+	}
+	e := AuditEntry{
+		SourceIP: c.ClientIP(),
+		Action:   action,
+		DeviceID: deviceID,
+		VM:       vm,
+		Outcome:  outcome,
+		Detail:   detail,
+	}
+	if u := currentUser(c); u != nil {
+		e.Actor = u.Username
+		e.ActorID = u.ID
+	}
+	if err := audit.Append(e); err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// 根据响应状态码判断操作结果
+func auditOutcome(c *gin.Context) string {
+	switch status := c.Writer.Status(); {
+	case status == http.StatusForbidden:
+		return AuditDenied
+	case status >= http.StatusBadRequest:
+		return AuditFailure
+	default:
+		return AuditSuccess
+	}
+}
+
+// 查询审计日志：from/to 为 RFC3339 时间，user、device_id、action 过滤，limit 默认 200
+func listAudit(c *gin.Context) {
+	f := auditFilter{Actor: c.Query("user"), Action: c.Query("action"), Limit: 200}
+	var err error
+	if v := c.Query("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from 时间格式错误"})
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to 时间格式错误"})
+			return
+		}
+	}
+	if v := c.Query("device_id"); v != "" {
+		if f.DeviceID, err = strconv.Atoi(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "device_id 错误"})
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit 错误"})
+			return
+		}
+	}
+
+	entries, err := audit.Query(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookieName = "ics_session"
+	sessionIdleTime   = time.Hour
+	sessionMaxTime    = 12 * time.Hour
+	ctxUserKey        = "user"
+	ctxSessionKey     = "session"
+)
+
+// 登录会话
+type authSession struct {
+	Token     string
+	UserID    int
+	CreatedAt time.Time
+	LastSeen  time.Time
+	// 最近一次完成二次验证的时间
+	StepUpAt time.Time
+}
+
+// 内存中的登录会话表
+type sessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*authSession
+}
+
+var sessions = &sessionManager{sessions: make(map[string]*authSession)}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (m *sessionManager) create(userID int) (*authSession, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &authSession{Token: token, UserID: userID, CreatedAt: now, LastSeen: now}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[token] = s
+	return s, nil
+}
+
+// 查找会话并刷新最后活动时间，过期会话顺带清理
+func (m *sessionManager) lookup(token string) (*authSession, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for t, s := range m.sessions {
+		if now.Sub(s.LastSeen) > sessionIdleTime || now.Sub(s.CreatedAt) > sessionMaxTime {
+			delete(m.sessions, t)
+		}
+	}
+	s, ok := m.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	s.LastSeen = now
+	return s, true
+}
+
+func (m *sessionManager) revoke(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, token)
+}
+
+func (m *sessionManager) revokeUser(userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for t, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, t)
+		}
+	}
+}
+
+// 记录会话完成二次验证的时间
+func (m *sessionManager) markStepUp(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[token]; ok {
+		s.StepUpAt = time.Now()
+	}
+}
+
+// 会话是否在 d 之内完成过二次验证
+func (m *sessionManager) steppedUpWithin(token string, d time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[token]
+	return ok && !s.StepUpAt.IsZero() && time.Since(s.StepUpAt) <= d
+}
+
+// 登录
+func login(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := authenticate(req.Username, req.Password)
+	if err != nil {
+		recordAudit(c, AuditLogin, 0, "", AuditFailure, "username="+req.Username)
+		// 稍作延迟，减缓暴力破解
+		time.Sleep(500 * time.Millisecond)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+		return
+	}
+
+	s, err := sessions.create(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(ctxUserKey, &u)
+	recordAudit(c, AuditLogin, 0, "", AuditSuccess, "")
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, s.Token, int(sessionMaxTime.Seconds()), "/", "", true, true)
+	c.JSON(http.StatusOK, redactUser(u))
+}
+
+// 退出登录
+func logout(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookieName); err == nil {
+		if u, ok := authenticateRequest(c); ok {
+			c.Set(ctxUserKey, &u)
+			recordAudit(c, AuditLogout, 0, "", AuditSuccess, "")
+		}
+		sessions.revoke(token)
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, "", -1, "/", "", true, true)
+	c.JSON(http.StatusOK, gin.H{"message": "已退出登录"})
+}
+
+// 当前登录用户信息
+func getMe(c *gin.Context) {
+	c.JSON(http.StatusOK, redactUser(*currentUser(c)))
+}
+
+// 认证中间件：校验会话并把用户放入上下文，页面请求未登录时跳转到登录页
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := authenticateRequest(c)
+		if !ok {
+			if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+				c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+				c.Abort()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+			return
+		}
+		c.Set(ctxUserKey, &u)
+		c.Next()
+	}
+}
+
+func authenticateRequest(c *gin.Context) (User, bool) {
+	if c.GetHeader("Authorization") != "" {
+		return authenticateBearer(c)
+	}
+	token, err := c.Cookie(sessionCookieName)
+	if err != nil || token == "" {
+		return User{}, false
+	}
+	s, ok := sessions.lookup(token)
+	if !ok {
+		return User{}, false
+	}
+	c.Set(ctxSessionKey, s)
+	// 每次请求都读取最新的用户信息，角色变更立即生效
+	u, err := users.Get(s.UserID)
+	if err != nil || u.Disabled {
+		sessions.revoke(token)
+		return User{}, false
+	}
+	return u, true
+}
+
+// 角色中间件，必须在 authRequired 之后使用
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := currentUser(c)
+		if u == nil || !roleAtLeast(u.Role, role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "权限不足"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 全局管理接口不接受限定了设备范围的 API 令牌，必须在 authRequired 之后使用
+func requireUnscoped() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if u := currentUser(c); u == nil || u.scopeDevices != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "令牌限定了设备范围，不能访问该接口"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 针对单个设备（路径参数 id）的接口，令牌范围外的设备一律拒绝
+func requireDeviceScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := currentUser(c)
+		id, err := strconv.Atoi(c.Param("id"))
+		if u == nil || (u.scopeDevices != nil && (err != nil || !u.inDeviceScope(id))) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "设备不在令牌范围内"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 获取当前请求的用户
+func currentUser(c *gin.Context) *User {
+	v, ok := c.Get(ctxUserKey)
+	if !ok {
+		return nil
+	}
+	return v.(*User)
+}
+
+// 获取当前请求的登录会话，API 令牌请求返回 nil
+func currentSession(c *gin.Context) *authSession {
+	v, ok := c.Get(ctxSessionKey)
+	if !ok {
+		return nil
+	}
+	return v.(*authSession)
+}
+
+// 允许跨域访问的来源，为空时只允许同源
+var allowedOrigins []string
+
+// WebSocket 来源校验：同源或在允许列表中
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range allowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
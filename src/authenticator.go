@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var errInvalidCredentials = errors.New("用户名或密码错误")
+
+// 认证后端，校验用户名密码并返回平台用户
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (User, error)
+}
+
+// 启用的认证后端，按顺序尝试，在 main 中初始化
+var authenticators []Authenticator
+
+// 依次尝试各认证后端，第一个成功的结果生效
+func authenticate(username, password string) (User, error) {
+	for _, a := range authenticators {
+		u, err := a.Authenticate(username, password)
+		if err == nil {
+			if u.Disabled {
+				return User{}, errInvalidCredentials
+			}
+			return u, nil
+		}
+		if err != errInvalidCredentials {
+			log.Printf("%s 认证失败: %v", a.Name(), err)
+		}
+	}
+	return User{}, errInvalidCredentials
+}
+
+// 本地账号认证
+type localAuthenticator struct {
+	store *userStore
+}
+
+func (a *localAuthenticator) Name() string { return "local" }
+
+func (a *localAuthenticator) Authenticate(username, password string) (User, error) {
+	u, err := a.store.GetByName(username)
+	if err != nil || u.Source != "" || !checkPassword(u, password) {
+		return User{}, errInvalidCredentials
+	}
+	return u, nil
+}
+
+// LDAP 配置
+type LDAPConfig struct {
+	// ldap://host:389 或 ldaps://host:636
+	URL                string `json:"url"`
+	StartTLS           bool   `json:"start_tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	TimeoutSeconds     int    `json:"timeout_seconds"`
+
+	// 用于搜索用户的服务账号，为空时匿名搜索
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+
+	BaseDN string `json:"base_dn"`
+	// 用户过滤条件，%s 替换为转义后的用户名，例如 (uid=%s)
+	UserFilter string `json:"user_filter"`
+	// 保存用户所属组的属性，默认 memberOf
+	GroupAttribute string `json:"group_attribute"`
+	// 组 DN 到平台角色的映射，用户属于多个组时取最高角色
+	GroupRoles map[string]string `json:"group_roles"`
+	// 没有匹配任何组时使用的角色，为空时拒绝登录
+	DefaultRole string `json:"default_role"`
+}
+
+func loadLDAPConfig(path string) (LDAPConfig, error) {
+	var cfg LDAPConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return cfg, errors.New("LDAP 配置缺少 url 或 base_dn")
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid=%s)"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 10
+	}
+	for group, role := range cfg.GroupRoles {
+		if _, ok := roleRank[role]; !ok {
+			return cfg, fmt.Errorf("组 %s 映射到未知角色 %s", group, role)
+		}
+	}
+	if _, ok := roleRank[cfg.DefaultRole]; cfg.DefaultRole != "" && !ok {
+		return cfg, fmt.Errorf("未知的默认角色 %s", cfg.DefaultRole)
+	}
+	return cfg, nil
+}
+
+// LDAP 连接中用到的操作，*ldap.Conn 实现了该接口，测试时可替换为进程内的 LDAP 替身
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAP 认证：服务账号搜索用户 DN，再以用户 DN 绑定校验密码，组成员关系映射为平台角色
+type ldapAuthenticator struct {
+	cfg   LDAPConfig
+	store *userStore
+	dial  func() (ldapConn, error)
+}
+
+func newLDAPAuthenticator(cfg LDAPConfig, store *userStore) (*ldapAuthenticator, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 LDAP CA 文件失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("LDAP CA 文件中没有有效证书")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	a := &ldapAuthenticator{cfg: cfg, store: store}
+	a.dial = func() (ldapConn, error) {
+		timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+		conn, err := ldap.DialURL(cfg.URL,
+			ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+			ldap.DialWithTLSConfig(tlsConfig))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(timeout)
+		if cfg.StartTLS {
+			if err := conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) Name() string { return "ldap" }
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (User, error) {
+	// 空密码会被 LDAP 服务器当作匿名绑定而成功，必须拒绝
+	if username == "" || password == "" {
+		return User{}, errInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return User{}, fmt.Errorf("连接 LDAP 失败: %v", err)
+	}
+	defer conn.Close()
+
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return User{}, fmt.Errorf("LDAP 服务账号绑定失败: %v", err)
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.cfg.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return User{}, fmt.Errorf("LDAP 搜索失败: %v", err)
+	}
+	if len(result.Entries) != 1 {
+		return User{}, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, errInvalidCredentials
+		}
+		return User{}, fmt.Errorf("LDAP 用户绑定失败: %v", err)
+	}
+
+	role := a.mapRole(entry.GetAttributeValues(a.cfg.GroupAttribute))
+	if role == "" {
+		return User{}, errInvalidCredentials
+	}
+	return a.store.UpsertExternal(username, "ldap", role)
+}
+
+// 根据组成员关系计算角色，取最高的角色
+func (a *ldapAuthenticator) mapRole(groups []string) string {
+	role := a.cfg.DefaultRole
+	for _, group := range groups {
+		for dn, r := range a.cfg.GroupRoles {
+			if strings.EqualFold(dn, group) && roleRank[r] > roleRank[role] {
+				role = r
+			}
+		}
+	}
+	return role
+}
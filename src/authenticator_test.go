@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// 进程内的 LDAP 替身：按 DN 校验密码，搜索返回预置的条目
+type fakeLDAPConn struct {
+	passwords map[string]string
+	entries   []*ldap.Entry
+	searchErr error
+
+	binds   []string
+	filters []string
+	closed  bool
+}
+
+func (f *fakeLDAPConn) Bind(username, password string) error {
+	f.binds = append(f.binds, username)
+	if p, ok := f.passwords[username]; ok && p == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (f *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	f.filters = append(f.filters, req.Filter)
+	if f.searchErr != nil {
+		return nil, f.searchErr
+	}
+	return &ldap.SearchResult{Entries: f.entries}, nil
+}
+
+func (f *fakeLDAPConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+const (
+	testBindDN   = "cn=svc,dc=example,dc=com"
+	testAliceDN  = "uid=alice,ou=people,dc=example,dc=com"
+	testAdmins   = "cn=admins,ou=groups,dc=example,dc=com"
+	testOps      = "cn=ops,ou=groups,dc=example,dc=com"
+	testOthersDN = "cn=others,ou=groups,dc=example,dc=com"
+)
+
+func testLDAPEntry(dn string, groups ...string) *ldap.Entry {
+	return ldap.NewEntry(dn, map[string][]string{"memberOf": groups})
+}
+
+func newTestLDAPAuthenticator(t *testing.T, conn *fakeLDAPConn, defaultRole string) *ldapAuthenticator {
+	t.Helper()
+	store, err := newUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ldapAuthenticator{
+		cfg: LDAPConfig{
+			BindDN:         testBindDN,
+			BindPassword:   "svc-secret",
+			BaseDN:         "dc=example,dc=com",
+			UserFilter:     "(uid=%s)",
+			GroupAttribute: "memberOf",
+			GroupRoles: map[string]string{
+				testAdmins: RoleAdmin,
+				testOps:    RoleOperator,
+			},
+			DefaultRole: defaultRole,
+		},
+		store: store,
+		dial:  func() (ldapConn, error) { return conn, nil },
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	passwords := map[string]string{testBindDN: "svc-secret", testAliceDN: "alice-secret"}
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		entries     []*ldap.Entry
+		defaultRole string
+		wantErr     error
+		wantRole    string
+		wantDial    bool
+	}{
+		{
+			name:     "绑定成功",
+			username: "alice", password: "alice-secret",
+			entries:  []*ldap.Entry{testLDAPEntry(testAliceDN, testOps)},
+			wantRole: RoleOperator, wantDial: true,
+		},
+		{
+			name:     "密码错误",
+			username: "alice", password: "wrong",
+			entries: []*ldap.Entry{testLDAPEntry(testAliceDN, testOps)},
+			wantErr: errInvalidCredentials, wantDial: true,
+		},
+		{
+			name:     "空密码不连接服务器",
+			username: "alice", password: "",
+			entries: []*ldap.Entry{testLDAPEntry(testAliceDN, testOps)},
+			wantErr: errInvalidCredentials,
+		},
+		{
+			name:     "用户不存在",
+			username: "alice", password: "alice-secret",
+			wantErr: errInvalidCredentials, wantDial: true,
+		},
+		{
+			name:     "搜索到多个条目",
+			username: "alice", password: "alice-secret",
+			entries: []*ldap.Entry{
+				testLDAPEntry(testAliceDN, testOps),
+				testLDAPEntry("uid=alice,ou=contractors,dc=example,dc=com", testAdmins),
+			},
+			wantErr: errInvalidCredentials, wantDial: true,
+		},
+		{
+			name:     "多个组取最高角色",
+			username: "alice", password: "alice-secret",
+			entries:  []*ldap.Entry{testLDAPEntry(testAliceDN, testOthersDN, testOps, "CN=Admins,OU=Groups,DC=example,DC=com")},
+			wantRole: RoleAdmin, wantDial: true,
+		},
+		{
+			name:     "没有匹配的组时拒绝",
+			username: "alice", password: "alice-secret",
+			entries: []*ldap.Entry{testLDAPEntry(testAliceDN, testOthersDN)},
+			wantErr: errInvalidCredentials, wantDial: true,
+		},
+		{
+			name:     "没有匹配的组时使用默认角色",
+			username: "alice", password: "alice-secret",
+			entries:     []*ldap.Entry{testLDAPEntry(testAliceDN, testOthersDN)},
+			defaultRole: RoleViewer,
+			wantRole:    RoleViewer, wantDial: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeLDAPConn{passwords: passwords, entries: tt.entries}
+			dialed := false
+			a := newTestLDAPAuthenticator(t, conn, tt.defaultRole)
+			a.dial = func() (ldapConn, error) {
+				dialed = true
+				return conn, nil
+			}
+
+			u, err := a.Authenticate(tt.username, tt.password)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if dialed != tt.wantDial {
+				t.Fatalf("dialed = %v, want %v", dialed, tt.wantDial)
+			}
+			if dialed && !conn.closed {
+				t.Error("连接未关闭")
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if u.Username != tt.username || u.Source != "ldap" || u.Role != tt.wantRole {
+				t.Errorf("user = %+v, want %s/ldap/%s", u, tt.username, tt.wantRole)
+			}
+			if len(conn.binds) != 2 || conn.binds[0] != testBindDN || conn.binds[1] != testAliceDN {
+				t.Errorf("binds = %v", conn.binds)
+			}
+		})
+	}
+}
+
+func TestLDAPServiceBindFailure(t *testing.T) {
+	conn := &fakeLDAPConn{passwords: map[string]string{testAliceDN: "alice-secret"}}
+	a := newTestLDAPAuthenticator(t, conn, "")
+	_, err := a.Authenticate("alice", "alice-secret")
+	if err == nil || err == errInvalidCredentials {
+		t.Fatalf("err = %v, want service bind error", err)
+	}
+	if len(conn.filters) != 0 {
+		t.Error("服务账号绑定失败后不应继续搜索")
+	}
+}
+
+func TestLDAPEscapesFilter(t *testing.T) {
+	conn := &fakeLDAPConn{passwords: map[string]string{testBindDN: "svc-secret"}}
+	a := newTestLDAPAuthenticator(t, conn, "")
+	a.Authenticate("*)(uid=*", "x")
+	if len(conn.filters) != 1 || conn.filters[0] != `(uid=\2a\29\28uid=\2a)` {
+		t.Fatalf("filters = %v", conn.filters)
+	}
+}
+
+func TestLDAPRoleSyncedOnLogin(t *testing.T) {
+	conn := &fakeLDAPConn{
+		passwords: map[string]string{testBindDN: "svc-secret", testAliceDN: "alice-secret"},
+		entries:   []*ldap.Entry{testLDAPEntry(testAliceDN, testAdmins)},
+	}
+	a := newTestLDAPAuthenticator(t, conn, "")
+	first, err := a.Authenticate("alice", "alice-secret")
+	if err != nil || first.Role != RoleAdmin {
+		t.Fatalf("first login: %+v, %v", first, err)
+	}
+
+	// 从管理员组移到运维组后，下次登录同步角色且保持同一账号
+	conn.entries = []*ldap.Entry{testLDAPEntry(testAliceDN, testOps)}
+	second, err := a.Authenticate("alice", "alice-secret")
+	if err != nil || second.Role != RoleOperator || second.ID != first.ID {
+		t.Fatalf("second login: %+v, %v", second, err)
+	}
+}
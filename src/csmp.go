@@ -1,13 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/ssh"
 )
 
 type VMIP struct {
@@ -30,43 +31,41 @@ func flushVM(c *gin.Context) {
 		return
 	}
 
-	var config *CSMPDevice
-	for i := range csmpDevices {
-		if fmt.Sprintf("%v", csmpDevices[i].ID) == deviceId {
-			config = &csmpDevices[i]
-			break
-		}
-	}
-	if config == nil {
+	config, ok := lookupDevice(deviceId)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
 		return
 	}
+	if !checkDeviceAction(c, config, ActionFlush) {
+		return
+	}
+	defer func() {
+		recordAudit(c, AuditVMRefresh, config.ID, "", auditOutcome(c), "")
+	}()
 
-	if config.SSHHost == "" || config.SSHPort == "" || config.SSHUser == "" || config.SSHPass == "" {
+	if !deviceHasSSHCredentials(config) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "SSH参数缺失"})
 		return
 	}
 
-	authMethods := []ssh.AuthMethod{ssh.Password(config.SSHPass)}
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUser,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.SSHHost, config.SSHPort), sshConfig)
+	result, err := refreshDeviceVMs(config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH connection failed"})
+		if writeHostKeyError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer client.Close()
+	c.JSON(http.StatusOK, result)
+}
 
-	session, err := client.NewSession()
+// 通过 SSH 获取设备上的虚拟机及其 IP 并保存到设备信息中，手动刷新和定时任务共用
+func refreshDeviceVMs(config *CSMPDevice) ([]VMItem, error) {
+	session, release, err := sshClients.Session(config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH session failed"})
-		return
+		return nil, fmt.Errorf("SSH connection failed: %w", err)
 	}
-	defer session.Close()
+	defer release()
 
 	// 统一批量获取: id|domain|state|novaName
 	var remoteCmd string
@@ -97,8 +96,7 @@ done
 
 	out, err := session.CombinedOutput(remoteCmd)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取 VM 列表失败"})
-		return
+		return nil, errors.New("获取 VM 列表失败")
 	}
 
 	var result []VMItem
@@ -152,19 +150,17 @@ done
 		})
 	}
 
-	session2, err := client.NewSession()
+	session2, release2, err := sshClients.Session(config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH session failed"})
-		return
+		return nil, fmt.Errorf("SSH session failed: %w", err)
 	}
-	defer session2.Close()
+	defer release2()
 	arpCmd := `bash -c '
 arp -an | awk "{print \$2 \"|\" \$4}"
 '`
 	out, err = session2.CombinedOutput(arpCmd)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取 VM 列表失败"})
-		return
+		return nil, errors.New("获取 VM 列表失败")
 	}
 
 	var ipAll []VMIP
@@ -204,11 +200,15 @@ arp -an | awk "{print \$2 \"|\" \$4}"
 		}
 	}
 
-	go func() { //刷新后更新数据
-		config.VM = result
-		config.Count = len(result)
-		config.TimeStamp = time.Now().Format("2006/1/2 15:04:05")
-		saveDeviceInfos()
-	}()
-	c.JSON(http.StatusOK, result)
+	//刷新后更新数据，只修改虚拟机相关字段，避免覆盖并发的配置编辑
+	_, err = deviceStore.Update(config.ID, func(dev *CSMPDevice) error {
+		dev.VM = result
+		dev.Count = len(result)
+		dev.TimeStamp = time.Now().Format("2006/1/2 15:04:05")
+		return nil
+	})
+	if err != nil {
+		log.Printf("保存虚拟机信息失败: %v", err)
+	}
+	return result, nil
 }
\ No newline at end of file
@@ -461,13 +461,13 @@ func parseTableHTMLToListItems(html string) ([]VMItem, error) {
 func flushVM(c *gin.Context) {
 	var loginURL, username, password string
 
-	id := c.Param("id")
-	for _, config := range csmpDevices {
-		if fmt.Sprintf("%d", config.ID) == id {
-			loginURL = config.LoginURL
-			username = config.Username
-			password = config.Password
+	if config, ok := lookupDevice(c.Param("id")); ok {
+		if !checkDeviceAction(c, config, ActionFlush) {
+			return
 		}
+		loginURL = config.LoginURL
+		username = config.Username
+		password = config.Password
 	}
 
 	if loginURL == "" || username == "" || password == "" {
@@ -1,15 +1,73 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
+// 根据字符串ID查找设备，返回设备副本
+func lookupDevice(idStr string) (*CSMPDevice, bool) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, false
+	}
+	dev, err := deviceStore.Get(id)
+	if err != nil {
+		return nil, false
+	}
+	return &dev, true
+}
+
+// 更新设备请求，ClearSecrets 用于显式清空只写字段
+type updateDeviceRequest struct {
+	CSMPDevice
+	ClearSecrets []string `json:"clear_secrets"`
+}
+
 // 配置管理相关函数
 func getDevices(c *gin.Context) {
-	c.JSON(http.StatusOK, csmpDevices)
+	devices, err := deviceStore.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取配置失败: " + err.Error()})
+		return
+	}
+	// 只返回当前用户可见的设备，并附带其可执行的操作
+	u := currentUser(c)
+	resp := []deviceResponse{}
+	for i := range devices {
+		actions := devicePermissions(u, &devices[i])
+		if len(actions) == 0 {
+			continue
+		}
+		dr := redactDevice(devices[i])
+		dr.Permissions = actions
+		resp = append(resp, dr)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// 设备配置校验失败，用于从 Update 回调中区分请求错误和存储错误
+type deviceValidationError struct {
+	err error
+}
+
+func (e *deviceValidationError) Error() string { return e.err.Error() }
+
+// 请求是否设置或清空了设备凭据
+func touchesDeviceSecrets(dev *CSMPDevice, clearSecrets []string) bool {
+	if len(clearSecrets) > 0 {
+		return true
+	}
+	for _, field := range deviceSecretFields(dev) {
+		if *field != "" {
+			return true
+		}
+	}
+	return false
 }
 
 func createDevice(c *gin.Context) {
@@ -19,59 +77,111 @@ func createDevice(c *gin.Context) {
 		return
 	}
 
-	config.ID = getNextConfigID()
-	csmpDevices = append(csmpDevices, config)
+	if mfaPolicy.DeviceEdit && touchesDeviceSecrets(&config, nil) && !checkFreshMFA(c) {
+		return
+	}
+	if err := validateDeviceSSHAuth(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// 保存到文件
-	if err := saveDeviceInfos(); err != nil {
+	config, err := deviceStore.Create(config)
+	if err != nil {
+		recordAudit(c, AuditDeviceCreate, 0, "", AuditFailure, err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, config)
+	recordAudit(c, AuditDeviceCreate, config.ID, "", AuditSuccess, config.Name)
+	c.JSON(http.StatusCreated, redactDevice(config))
 }
 
 func updateDevice(c *gin.Context) {
-	id := c.Param("id")
-	var updatedConfig CSMPDevice
-	if err := c.ShouldBindJSON(&updatedConfig); err != nil {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	var req updateDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	updatedConfig := req.CSMPDevice
+	if mfaPolicy.DeviceEdit && touchesDeviceSecrets(&updatedConfig, req.ClearSecrets) && !checkFreshMFA(c) {
+		return
+	}
 
-	for i, config := range csmpDevices {
-		if fmt.Sprintf("%d", config.ID) == id {
-			updatedConfig.ID = config.ID
-			csmpDevices[i] = updatedConfig
+	config, err := deviceStore.Update(id, func(dev *CSMPDevice) error {
+		// 虚拟机信息由刷新接口维护，编辑配置时保留
+		updatedConfig.VM = dev.VM
+		updatedConfig.Count = dev.Count
+		updatedConfig.TimeStamp = dev.TimeStamp
 
-			// 保存到文件
-			if err := saveDeviceInfos(); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败: " + err.Error()})
-				return
+		// 敏感字段只写：未填写时保留原值，clear_secrets 中列出的字段清空
+		preserveDeviceSecrets(dev, &updatedConfig)
+		newSecrets := deviceSecretFields(&updatedConfig)
+		for _, name := range req.ClearSecrets {
+			if field, ok := newSecrets[name]; ok {
+				*field = ""
 			}
+		}
 
-			c.JSON(http.StatusOK, updatedConfig)
-			return
+		if err := validateDeviceSSHAuth(&updatedConfig); err != nil {
+			return &deviceValidationError{err}
 		}
+
+		*dev = updatedConfig
+		return nil
+	})
+	if err == errDeviceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	var invalid *deviceValidationError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		recordAudit(c, AuditDeviceUpdate, id, "", AuditFailure, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败: " + err.Error()})
+		return
+	}
+
+	detail := config.Name
+	if touchesDeviceSecrets(&req.CSMPDevice, req.ClearSecrets) {
+		detail += "（修改凭据）"
 	}
-	c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+	recordAudit(c, AuditDeviceUpdate, id, "", AuditSuccess, detail)
+	c.JSON(http.StatusOK, redactDevice(config))
 }
 
 func deleteConfig(c *gin.Context) {
-	id := c.Param("id")
-	for i, config := range csmpDevices {
-		if fmt.Sprintf("%d", config.ID) == id {
-			csmpDevices = append(csmpDevices[:i], csmpDevices[i+1:]...)
-
-			// 保存到文件
-			if err := saveDeviceInfos(); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败: " + err.Error()})
-				return
-			}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
 
-			c.JSON(http.StatusOK, gin.H{"message": "配置已删除"})
-			return
-		}
+	err = deviceStore.Delete(id)
+	if err == errDeviceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	if err != nil {
+		recordAudit(c, AuditDeviceDelete, id, "", AuditFailure, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置失败: " + err.Error()})
+		return
+	}
+	recordAudit(c, AuditDeviceDelete, id, "", AuditSuccess, "")
+	// 清理指向该设备的授权
+	if _, err := grants.DeleteWhere(func(g Grant) bool { return g.DeviceID == id }); err != nil {
+		log.Printf("清理设备 %d 的授权失败: %v", id, err)
 	}
-	c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
-}
\ No newline at end of file
+	if _, err := knownHosts.DeleteDevice(id); err != nil {
+		log.Printf("清理设备 %d 的主机密钥失败: %v", id, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "配置已删除"})
+}
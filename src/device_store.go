@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// 设备存储接口，所有对设备配置的读写都经过这里
+type DeviceStore interface {
+	Get(id int) (CSMPDevice, error)
+	List() ([]CSMPDevice, error)
+	Create(dev CSMPDevice) (CSMPDevice, error)
+	// Update 在存储锁内对设备做读-改-写，fn 返回错误时放弃修改
+	Update(id int, fn func(dev *CSMPDevice) error) (CSMPDevice, error)
+	Delete(id int) error
+	// Watch 订阅设备变更事件，返回的函数用于取消订阅
+	Watch() (<-chan DeviceEvent, func())
+	Close() error
+}
+
+// 设备变更事件类型
+const (
+	DeviceCreated = "created"
+	DeviceUpdated = "updated"
+	DeviceDeleted = "deleted"
+)
+
+// 设备变更事件
+type DeviceEvent struct {
+	Type   string     `json:"type"`
+	Device CSMPDevice `json:"device"`
+}
+
+var errDeviceNotFound = errors.New("设备不存在")
+
+// 全局设备存储，在 main 中根据启动参数初始化
+var deviceStore DeviceStore
+
+// 根据类型打开设备存储
+func openDeviceStore(kind, path string) (DeviceStore, error) {
+	switch kind {
+	case "", "file":
+		if path == "" {
+			path = "devices.json"
+		}
+		return newFileDeviceStore(path)
+	case "bolt":
+		if path == "" {
+			path = "devices.db"
+		}
+		return newBoltDeviceStore(path)
+	default:
+		return nil, fmt.Errorf("未知的存储类型: %s", kind)
+	}
+}
+
+// 复制设备，避免调用方与存储共享切片
+func cloneDevice(dev CSMPDevice) CSMPDevice {
+	if dev.Tags != nil {
+		dev.Tags = append([]string(nil), dev.Tags...)
+	}
+	if dev.JumpHosts != nil {
+		dev.JumpHosts = append([]JumpHost(nil), dev.JumpHosts...)
+	}
+	if dev.VM != nil {
+		vms := make([]VMItem, len(dev.VM))
+		for i, vm := range dev.VM {
+			if vm.IP != nil {
+				vm.IP = append([]VMIP(nil), vm.IP...)
+			}
+			vms[i] = vm
+		}
+		dev.VM = vms
+	}
+	return dev
+}
+
+// 变更事件广播
+type deviceWatchHub struct {
+	mu       sync.Mutex
+	nextID   int
+	watchers map[int]chan DeviceEvent
+}
+
+func (h *deviceWatchHub) watch() (<-chan DeviceEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[int]chan DeviceEvent)
+	}
+	h.nextID++
+	id := h.nextID
+	ch := make(chan DeviceEvent, 16)
+	h.watchers[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.watchers, id)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (h *deviceWatchHub) publish(eventType string, dev CSMPDevice) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.watchers {
+		// 订阅者处理不过来时丢弃事件，不阻塞写入
+		select {
+		case ch <- DeviceEvent{Type: eventType, Device: cloneDevice(dev)}:
+		default:
+		}
+	}
+}
+
+func (h *deviceWatchHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, ch := range h.watchers {
+		delete(h.watchers, id)
+		close(ch)
+	}
+}
+
+// 基于 JSON 文件的设备存储
+type fileDeviceStore struct {
+	mu      sync.Mutex
+	path    string
+	devices []CSMPDevice
+	// 已分配过的最大ID，删除设备后也不回退，避免新设备复用旧ID
+	lastID int
+	hub    deviceWatchHub
+}
+
+func newFileDeviceStore(path string) (*fileDeviceStore, error) {
+	s := &fileDeviceStore{path: path, devices: []CSMPDevice{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// 如果文件不存在，创建默认配置
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.lastID, err = unmarshalIDFile(data, "devices", &s.devices, func(d CSMPDevice) int { return d.ID })
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	sort.Slice(s.devices, func(i, j int) bool { return s.devices[i].ID < s.devices[j].ID })
+	return s, nil
+}
+
+func (s *fileDeviceStore) Get(id int) (CSMPDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return CSMPDevice{}, errDeviceNotFound
+	}
+	return cloneDevice(s.devices[i]), nil
+}
+
+func (s *fileDeviceStore) List() ([]CSMPDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]CSMPDevice, len(s.devices))
+	for i, dev := range s.devices {
+		list[i] = cloneDevice(dev)
+	}
+	return list, nil
+}
+
+func (s *fileDeviceStore) Create(dev CSMPDevice) (CSMPDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// ID 只增不减，已删除设备的ID不会再分配
+	dev = cloneDevice(dev)
+	s.lastID++
+	dev.ID = s.lastID
+
+	s.devices = append(s.devices, dev)
+	if err := s.save(); err != nil {
+		s.devices = s.devices[:len(s.devices)-1]
+		s.lastID--
+		return CSMPDevice{}, err
+	}
+	s.hub.publish(DeviceCreated, dev)
+	return cloneDevice(dev), nil
+}
+
+func (s *fileDeviceStore) Update(id int, fn func(dev *CSMPDevice) error) (CSMPDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return CSMPDevice{}, errDeviceNotFound
+	}
+
+	old := s.devices[i]
+	dev := cloneDevice(old)
+	if err := fn(&dev); err != nil {
+		return CSMPDevice{}, err
+	}
+	dev.ID = id
+
+	s.devices[i] = dev
+	if err := s.save(); err != nil {
+		s.devices[i] = old
+		return CSMPDevice{}, err
+	}
+	s.hub.publish(DeviceUpdated, dev)
+	return cloneDevice(dev), nil
+}
+
+func (s *fileDeviceStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return errDeviceNotFound
+	}
+
+	old := s.devices
+	dev := s.devices[i]
+	s.devices = append(append([]CSMPDevice{}, s.devices[:i]...), s.devices[i+1:]...)
+	if err := s.save(); err != nil {
+		s.devices = old
+		return err
+	}
+	s.hub.publish(DeviceDeleted, dev)
+	return nil
+}
+
+func (s *fileDeviceStore) Watch() (<-chan DeviceEvent, func()) {
+	return s.hub.watch()
+}
+
+func (s *fileDeviceStore) Close() error {
+	s.hub.closeAll()
+	return nil
+}
+
+func (s *fileDeviceStore) index(id int) int {
+	for i := range s.devices {
+		if s.devices[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 保存配置到文件，调用方需持有锁
+func (s *fileDeviceStore) save() error {
+	data, err := marshalIDFile("devices", s.lastID, s.devices)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// 先写临时文件并 fsync，再 rename 覆盖目标文件，避免写一半时进程退出导致文件损坏
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	// 同步目录项，保证 rename 落盘（Windows 不支持对目录 fsync，忽略错误）
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// 读取带自增ID的存储文件，格式为 {"last_id": n, "<key>": [...]}，早期版本只保存记录数组。
+// 返回已分配过的最大ID，不小于现有记录的ID，保证删除记录后ID也不会被再次分配
+func unmarshalIDFile[T any](data []byte, key string, items *[]T, id func(T) int) (int, error) {
+	lastID := 0
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(data, items); err != nil {
+			return 0, err
+		}
+	} else {
+		var file map[string]json.RawMessage
+		if err := json.Unmarshal(data, &file); err != nil {
+			return 0, err
+		}
+		if raw, ok := file["last_id"]; ok {
+			if err := json.Unmarshal(raw, &lastID); err != nil {
+				return 0, err
+			}
+		}
+		if raw, ok := file[key]; ok && !bytes.Equal(raw, []byte("null")) {
+			if err := json.Unmarshal(raw, items); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, item := range *items {
+		lastID = max(lastID, id(item))
+	}
+	return lastID, nil
+}
+
+func marshalIDFile[T any](key string, lastID int, items []T) ([]byte, error) {
+	return json.MarshalIndent(map[string]any{"last_id": lastID, key: items}, "", "  ")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltDevicesBucket = []byte("devices")
+
+// 基于 bbolt 嵌入式数据库的设备存储
+type boltDeviceStore struct {
+	db  *bolt.DB
+	hub deviceWatchHub
+}
+
+func newBoltDeviceStore(path string) (*boltDeviceStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltDevicesBucket)
+		if err != nil {
+			return err
+		}
+		// 早期版本按最大键加一分配ID，没有使用序列，序列从现有的最大ID开始
+		if k, _ := b.Cursor().Last(); k != nil {
+			if last := binary.BigEndian.Uint64(k); b.Sequence() < last {
+				return b.SetSequence(last)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDeviceStore{db: db}, nil
+}
+
+func boltKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func (s *boltDeviceStore) Get(id int) (CSMPDevice, error) {
+	var dev CSMPDevice
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltDevicesBucket).Get(boltKey(id))
+		if data == nil {
+			return errDeviceNotFound
+		}
+		return json.Unmarshal(data, &dev)
+	})
+	return dev, err
+}
+
+func (s *boltDeviceStore) List() ([]CSMPDevice, error) {
+	list := []CSMPDevice{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDevicesBucket).ForEach(func(k, v []byte) error {
+			var dev CSMPDevice
+			if err := json.Unmarshal(v, &dev); err != nil {
+				return err
+			}
+			list = append(list, dev)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltDeviceStore) Create(dev CSMPDevice) (CSMPDevice, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevicesBucket)
+		// 序列只增不减，已删除设备的ID不会再分配
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		dev.ID = int(seq)
+		data, err := json.Marshal(dev)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(dev.ID), data)
+	})
+	if err != nil {
+		return CSMPDevice{}, err
+	}
+	s.hub.publish(DeviceCreated, dev)
+	return cloneDevice(dev), nil
+}
+
+func (s *boltDeviceStore) Update(id int, fn func(dev *CSMPDevice) error) (CSMPDevice, error) {
+	var dev CSMPDevice
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevicesBucket)
+		data := b.Get(boltKey(id))
+		if data == nil {
+			return errDeviceNotFound
+		}
+		if err := json.Unmarshal(data, &dev); err != nil {
+			return err
+		}
+		if err := fn(&dev); err != nil {
+			return err
+		}
+		dev.ID = id
+		data, err := json.Marshal(dev)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(id), data)
+	})
+	if err != nil {
+		return CSMPDevice{}, err
+	}
+	s.hub.publish(DeviceUpdated, dev)
+	return dev, nil
+}
+
+func (s *boltDeviceStore) Delete(id int) error {
+	var dev CSMPDevice
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevicesBucket)
+		data := b.Get(boltKey(id))
+		if data == nil {
+			return errDeviceNotFound
+		}
+		if err := json.Unmarshal(data, &dev); err != nil {
+			return err
+		}
+		return b.Delete(boltKey(id))
+	})
+	if err != nil {
+		return err
+	}
+	s.hub.publish(DeviceDeleted, dev)
+	return nil
+}
+
+func (s *boltDeviceStore) Watch() (<-chan DeviceEvent, func()) {
+	return s.hub.watch()
+}
+
+func (s *boltDeviceStore) Close() error {
+	s.hub.closeAll()
+	return s.db.Close()
+}
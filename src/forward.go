@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 端口转发的访问方式
+const (
+	ForwardWebSocket = "websocket" // 通过 /api/forwards/:id/ws 的 websocket 连接
+	ForwardListener  = "listener"  // 服务端临时监听的 TCP 端口
+)
+
+const (
+	forwardDefaultTTL = time.Hour
+	forwardMaxTTL     = 24 * time.Hour
+	forwardPerUser    = 10 // 每个用户同时存在的转发数
+)
+
+// 监听方式的转发绑定的地址，在 main 中根据启动参数设置，为空时不允许监听方式
+var forwardListenHost string
+
+// 经设备的 SSH 连接（direct-tcpip）转发到设备一侧网络中的地址
+type PortForward struct {
+	ID          string    `json:"id"`
+	DeviceID    int       `json:"device_id"`
+	Device      string    `json:"device"`
+	Target      string    `json:"target"` // 由设备解析的 host:port
+	Mode        string    `json:"mode"`
+	Listen      string    `json:"listen,omitempty"`   // 监听方式的服务端地址
+	AllowIP     string    `json:"allow_ip,omitempty"` // 监听方式只接受该地址的连接
+	URL         string    `json:"url,omitempty"`      // websocket 方式的连接地址
+	OwnerID     int       `json:"owner_id"`
+	Owner       string    `json:"owner"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Active      int64     `json:"active"`      // 当前连接数
+	Connections int64     `json:"connections"` // 累计连接数
+	BytesIn     int64     `json:"bytes_in"`    // 发往目标的字节数
+	BytesOut    int64     `json:"bytes_out"`   // 从目标返回的字节数
+}
+
+// 运行中的转发
+type portForward struct {
+	PortForward
+	ownerIP   string
+	listener  net.Listener
+	timer     *time.Timer
+	mu        sync.Mutex
+	conns     map[io.Closer]struct{}
+	closed    bool
+	closeOnce sync.Once
+}
+
+var errForwardNotFound = errors.New("端口转发不存在")
+
+// 内存中的转发表，重启后全部关闭
+type forwardStore struct {
+	mu       sync.Mutex
+	forwards map[string]*portForward
+}
+
+var forwards = &forwardStore{forwards: make(map[string]*portForward)}
+
+func (s *forwardStore) Get(id string) (*portForward, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.forwards[id]
+	return f, ok
+}
+
+// 按创建时间排列
+func (s *forwardStore) List() []*portForward {
+	s.mu.Lock()
+	list := make([]*portForward, 0, len(s.forwards))
+	for _, f := range s.forwards {
+		list = append(list, f)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// 登记转发，超过每个用户的数量上限时拒绝
+func (s *forwardStore) add(f *portForward) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, existing := range s.forwards {
+		if existing.OwnerID == f.OwnerID {
+			n++
+		}
+	}
+	if n >= forwardPerUser {
+		return fmt.Errorf("每个用户最多同时保留 %d 个端口转发", forwardPerUser)
+	}
+	s.forwards[f.ID] = f
+	return nil
+}
+
+// 当前状态，计数用原子操作读取
+func (f *portForward) snapshot() PortForward {
+	return PortForward{
+		ID:          f.ID,
+		DeviceID:    f.DeviceID,
+		Device:      f.Device,
+		Target:      f.Target,
+		Mode:        f.Mode,
+		Listen:      f.Listen,
+		AllowIP:     f.AllowIP,
+		URL:         f.URL,
+		OwnerID:     f.OwnerID,
+		Owner:       f.Owner,
+		CreatedAt:   f.CreatedAt,
+		ExpiresAt:   f.ExpiresAt,
+		Active:      atomic.LoadInt64(&f.Active),
+		Connections: atomic.LoadInt64(&f.Connections),
+		BytesIn:     atomic.LoadInt64(&f.BytesIn),
+		BytesOut:    atomic.LoadInt64(&f.BytesOut),
+	}
+}
+
+// 关闭转发：停止监听并断开所有连接
+func (f *portForward) Close(reason string) {
+	f.closeOnce.Do(func() {
+		forwards.mu.Lock()
+		delete(forwards.forwards, f.ID)
+		forwards.mu.Unlock()
+
+		f.mu.Lock()
+		f.closed = true
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		if f.listener != nil {
+			f.listener.Close()
+		}
+		for conn := range f.conns {
+			conn.Close()
+		}
+		f.mu.Unlock()
+
+		f.audit(AuditForwardClose, AuditSuccess, fmt.Sprintf("%s %s 连接 %d 次 发送 %d 字节 接收 %d 字节 %s",
+			f.ID, f.Target, atomic.LoadInt64(&f.Connections), atomic.LoadInt64(&f.BytesIn), atomic.LoadInt64(&f.BytesOut), reason))
+	})
+}
+
+// 转发在后台关闭或接受连接，以创建者的名义记入审计
+func (f *portForward) audit(action, outcome, detail string) {
+	if audit == nil {
+		return
+	}
+	err := audit.Append(AuditEntry{
+		Actor:    f.Owner,
+		ActorID:  f.OwnerID,
+		SourceIP: f.ownerIP,
+		Action:   action,
+		DeviceID: f.DeviceID,
+		Outcome:  outcome,
+		Detail:   detail,
+	})
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// 每个新连接都重新检查创建者的权限，权限被收回后关闭转发
+func (f *portForward) device() (*CSMPDevice, error) {
+	owner, err := users.Get(f.OwnerID)
+	if err != nil || owner.Disabled {
+		f.Close("创建者账号不存在或已停用")
+		return nil, errors.New("创建者账号不存在或已停用")
+	}
+	dev, err := deviceStore.Get(f.DeviceID)
+	if err != nil {
+		f.Close("设备已删除")
+		return nil, err
+	}
+	if !deviceAllowed(&owner, &dev, ActionForward) {
+		f.audit(AuditAccessDenied, AuditDenied, ActionForward+" "+f.ID)
+		f.Close("权限已被收回")
+		return nil, errors.New("没有该设备的操作权限")
+	}
+	return &dev, nil
+}
+
+// 登记连接，转发关闭后不再接受新连接
+func (f *portForward) track(conn io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *portForward) untrack(conn io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, conn)
+	f.mu.Unlock()
+	conn.Close()
+}
+
+// 经设备的 SSH 连接打开到目标的通道，每个接受的连接都记入审计
+func (f *portForward) dial(remote string) (net.Conn, error) {
+	dev, err := f.device()
+	if err == nil {
+		var target net.Conn
+		if target, err = sshClients.Dial(dev, f.Target); err == nil {
+			f.audit(AuditForwardConnect, AuditSuccess, fmt.Sprintf("%s %s 来自 %s", f.ID, f.Target, remote))
+			return target, nil
+		}
+		err = fmt.Errorf("连接 %s 失败: %w", f.Target, err)
+	}
+	f.audit(AuditForwardConnect, AuditFailure, fmt.Sprintf("%s %s 来自 %s: %v", f.ID, f.Target, remote, err))
+	return nil, err
+}
+
+// 双向复制，任一方向结束或转发关闭后断开两侧
+func (f *portForward) pipe(client io.ReadWriteCloser, target net.Conn) {
+	if !f.track(client) || !f.track(target) {
+		client.Close()
+		target.Close()
+		return
+	}
+	defer f.untrack(client)
+	defer f.untrack(target)
+
+	atomic.AddInt64(&f.Connections, 1)
+	atomic.AddInt64(&f.Active, 1)
+	defer atomic.AddInt64(&f.Active, -1)
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(target, client)
+		atomic.AddInt64(&f.BytesIn, n)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(client, target)
+		atomic.AddInt64(&f.BytesOut, n)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// 监听方式：只接受创建者所在地址的连接
+func (f *portForward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if f.AllowIP != "" && host != f.AllowIP {
+			log.Printf("端口转发 %s 拒绝来自 %s 的连接", f.ID, conn.RemoteAddr())
+			f.audit(AuditForwardConnect, AuditDenied, fmt.Sprintf("%s %s 来自 %s", f.ID, f.Target, conn.RemoteAddr()))
+			conn.Close()
+			continue
+		}
+		go func() {
+			target, err := f.dial(conn.RemoteAddr().String())
+			if err != nil {
+				log.Printf("端口转发 %s: %v", f.ID, err)
+				conn.Close()
+				return
+			}
+			f.pipe(conn, target)
+		}()
+	}
+}
+
+// 端口转发接口
+type createForwardRequest struct {
+	Target string `json:"target"`
+	Mode   string `json:"mode"`
+	TTL    int    `json:"ttl"` // 秒
+}
+
+func createForward(c *gin.Context) {
+	config, ok := lookupDevice(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
+		return
+	}
+	if !checkDeviceAction(c, config, ActionForward) {
+		return
+	}
+	var req createForwardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	host, port, err := net.SplitHostPort(req.Target)
+	if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "目标地址格式应为 host:port"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = ForwardWebSocket
+	}
+	if req.Mode != ForwardWebSocket && req.Mode != ForwardListener {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未知的转发方式: " + req.Mode})
+		return
+	}
+	if req.Mode == ForwardListener && forwardListenHost == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "服务端未开启监听方式的端口转发"})
+		return
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = forwardDefaultTTL
+	}
+	if ttl > forwardMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("有效期不能超过 %s", forwardMaxTTL)})
+		return
+	}
+	if !deviceHasSSHCredentials(config) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SSH参数缺失"})
+		return
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	now := time.Now()
+	f := &portForward{
+		PortForward: PortForward{
+			ID:        id,
+			DeviceID:  config.ID,
+			Device:    config.Name,
+			Target:    req.Target,
+			Mode:      req.Mode,
+			OwnerID:   user.ID,
+			Owner:     user.Username,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		ownerIP: c.ClientIP(),
+		conns:   make(map[io.Closer]struct{}),
+	}
+	if f.Mode == ForwardWebSocket {
+		f.URL = "/api/forwards/" + id + "/ws"
+	} else {
+		f.listener, err = net.Listen("tcp", net.JoinHostPort(forwardListenHost, "0"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "监听端口失败: " + err.Error()})
+			return
+		}
+		f.Listen = f.listener.Addr().String()
+		f.AllowIP = c.ClientIP()
+	}
+	if err := forwards.add(f); err != nil {
+		if f.listener != nil {
+			f.listener.Close()
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	f.mu.Lock()
+	f.timer = time.AfterFunc(ttl, func() { f.Close("已过期") })
+	f.mu.Unlock()
+	if f.listener != nil {
+		go f.serve()
+	}
+
+	detail := fmt.Sprintf("%s %s %s 有效期 %s", id, req.Target, f.Mode, ttl)
+	if f.Listen != "" {
+		detail += " 监听 " + f.Listen
+	}
+	recordAudit(c, AuditForwardCreate, config.ID, "", AuditSuccess, detail)
+	c.JSON(http.StatusCreated, f.snapshot())
+}
+
+// 当前用户的端口转发，管理员可以看到所有转发
+func listForwards(c *gin.Context) {
+	user := currentUser(c)
+	result := []PortForward{}
+	for _, f := range forwards.List() {
+		if f.OwnerID == user.ID || roleAtLeast(user.Role, RoleAdmin) {
+			result = append(result, f.snapshot())
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// 只有创建者可以使用转发，创建者和管理员可以关闭转发
+func forwardForRequest(c *gin.Context, allowAdmin bool) (*portForward, bool) {
+	f, ok := forwards.Get(c.Param("id"))
+	user := currentUser(c)
+	if !ok || (f.OwnerID != user.ID && !(allowAdmin && roleAtLeast(user.Role, RoleAdmin))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errForwardNotFound.Error()})
+		return nil, false
+	}
+	return f, true
+}
+
+func deleteForward(c *gin.Context) {
+	f, ok := forwardForRequest(c, true)
+	if !ok {
+		return
+	}
+	f.Close("由 " + currentUser(c).Username + " 关闭")
+	c.JSON(http.StatusOK, gin.H{"message": "端口转发已关闭"})
+}
+
+// websocket 方式：二进制消息与目标 TCP 连接之间双向转发
+func handleForwardWebSocket(c *gin.Context) {
+	f, ok := forwardForRequest(c, false)
+	if !ok {
+		return
+	}
+	ws, err := upgraderVNC.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket升级失败: %v", err)
+		return
+	}
+	target, err := f.dial("websocket " + c.ClientIP())
+	if err != nil {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()), time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+	f.pipe(&wsConn{wsStream{ws: ws}}, target)
+}
+
+// 可关闭的 websocket 字节流
+type wsConn struct {
+	wsStream
+}
+
+func (w *wsConn) Close() error { return w.ws.Close() }
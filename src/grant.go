@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 设备操作类型
+const (
+	ActionView     = "view"     // 在设备列表中可见
+	ActionWebShell = "webshell" // 打开 WebShell
+	ActionVNC      = "vnc"      // 打开虚拟机 VNC
+	ActionFlush    = "flush"    // 刷新虚拟机信息
+	ActionSFTP     = "sftp"     // 浏览和传输设备上的文件
+	ActionForward  = "forward"  // 经设备的 SSH 连接转发端口
+)
+
+// 各操作要求的最低角色，授权不能超出角色本身的能力
+var actionMinRole = map[string]string{
+	ActionView:     RoleViewer,
+	ActionWebShell: RoleOperator,
+	ActionVNC:      RoleViewer,
+	ActionFlush:    RoleOperator,
+	ActionSFTP:     RoleOperator,
+	ActionForward:  RoleOperator,
+}
+
+// 授权所有设备时使用的标签
+const grantAllDevices = "*"
+
+// 授权记录：把某个设备或某个标签下的设备的若干操作授予用户
+type Grant struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	DeviceID  int       `json:"device_id,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Actions   []string  `json:"actions"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 授权是否覆盖该设备
+func (g Grant) matches(dev *CSMPDevice) bool {
+	if g.DeviceID != 0 {
+		return g.DeviceID == dev.ID
+	}
+	if g.Tag == grantAllDevices {
+		return true
+	}
+	for _, tag := range dev.Tags {
+		if tag == g.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// 授权是否包含该操作，任何操作都隐含可见
+func (g Grant) allows(action string) bool {
+	for _, a := range g.Actions {
+		if a == action || action == ActionView {
+			return true
+		}
+	}
+	return false
+}
+
+func validateGrant(g Grant) error {
+	if g.UserID == 0 {
+		return errors.New("缺少用户")
+	}
+	if (g.DeviceID == 0) == (g.Tag == "") {
+		return errors.New("设备ID和标签必须且只能指定一个")
+	}
+	if len(g.Actions) == 0 {
+		return errors.New("至少需要一个操作")
+	}
+	for _, a := range g.Actions {
+		if _, ok := actionMinRole[a]; !ok {
+			return fmt.Errorf("未知操作: %s", a)
+		}
+	}
+	return nil
+}
+
+// 授权存储，保存在 JSON 文件中
+type grantStore struct {
+	mu     sync.Mutex
+	path   string
+	grants []Grant
+	lastID int // 已分配过的最大ID，删除后不回退
+}
+
+// 全局授权存储，在 main 中初始化
+var grants *grantStore
+
+func newGrantStore(path string) (*grantStore, error) {
+	s := &grantStore{path: path, grants: []Grant{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.lastID, err = unmarshalIDFile(data, "grants", &s.grants, func(g Grant) int { return g.ID }); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	return s, nil
+}
+
+// 保存授权到文件，调用方需持有锁
+func (s *grantStore) save() error {
+	data, err := marshalIDFile("grants", s.lastID, s.grants)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+func (s *grantStore) List() []Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Grant{}, s.grants...)
+}
+
+func (s *grantStore) ForUser(userID int) []Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Grant
+	for _, g := range s.grants {
+		if g.UserID == userID {
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+func (s *grantStore) Create(g Grant) (Grant, error) {
+	if err := validateGrant(g); err != nil {
+		return Grant{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	g.ID = s.lastID
+	g.CreatedAt = time.Now()
+
+	s.grants = append(s.grants, g)
+	if err := s.save(); err != nil {
+		s.grants = s.grants[:len(s.grants)-1]
+		s.lastID--
+		return Grant{}, err
+	}
+	return g, nil
+}
+
+// 删除满足条件的授权，返回删除的条数
+func (s *grantStore) DeleteWhere(match func(g Grant) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []Grant{}
+	for _, g := range s.grants {
+		if !match(g) {
+			kept = append(kept, g)
+		}
+	}
+	n := len(s.grants) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	old := s.grants
+	s.grants = kept
+	if err := s.save(); err != nil {
+		s.grants = old
+		return 0, err
+	}
+	return n, nil
+}
+
+// 判断用户能否对设备执行某个操作：角色必须满足操作要求，非管理员还需要有匹配的授权
+func deviceAllowed(u *User, dev *CSMPDevice, action string) bool {
+	if u == nil || !roleAtLeast(u.Role, actionMinRole[action]) {
+		return false
+	}
+	// API 令牌限定了设备范围时，范围外的设备一律拒绝
+	if !u.inDeviceScope(dev.ID) {
+		return false
+	}
+	if u.Role == RoleAdmin {
+		return true
+	}
+	for _, g := range grants.ForUser(u.ID) {
+		if g.matches(dev) && g.allows(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// 用户对设备的全部有效操作
+func devicePermissions(u *User, dev *CSMPDevice) []string {
+	var actions []string
+	for _, a := range []string{ActionView, ActionWebShell, ActionVNC, ActionFlush, ActionSFTP, ActionForward} {
+		if deviceAllowed(u, dev, a) {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// 设备操作鉴权，失败时写入 403 响应
+func checkDeviceAction(c *gin.Context, dev *CSMPDevice, action string) bool {
+	if deviceAllowed(currentUser(c), dev, action) {
+		return true
+	}
+	recordAudit(c, AuditAccessDenied, dev.ID, "", AuditDenied, action)
+	c.JSON(http.StatusForbidden, gin.H{"error": "没有该设备的操作权限"})
+	return false
+}
+
+// 授权管理接口
+func listGrants(c *gin.Context) {
+	list := grants.List()
+	if userID, err := strconv.Atoi(c.Query("user_id")); err == nil {
+		list = grants.ForUser(userID)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func createGrant(c *gin.Context) {
+	var g Grant
+	if err := c.ShouldBindJSON(&g); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := users.Get(g.UserID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if g.DeviceID != 0 {
+		if _, err := deviceStore.Get(g.DeviceID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	g.CreatedBy = currentUser(c).Username
+	g, err := grants.Create(g)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, g)
+}
+
+func deleteGrant(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "授权不存在"})
+		return
+	}
+	n, err := grants.DeleteWhere(func(g Grant) bool { return g.ID == id })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "授权不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "授权已删除"})
+}
+
+// 设备的有效权限
+type devicePermission struct {
+	DeviceID   int      `json:"device_id"`
+	DeviceName string   `json:"device_name"`
+	Actions    []string `json:"actions"`
+}
+
+// 查询有效权限，默认查询自己，管理员可以通过 user_id 查询其他用户
+func getEffectivePermissions(c *gin.Context) {
+	u := currentUser(c)
+	if idStr := c.Query("user_id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id 错误"})
+			return
+		}
+		if id != u.ID {
+			if u.Role != RoleAdmin {
+				c.JSON(http.StatusForbidden, gin.H{"error": "权限不足"})
+				return
+			}
+			other, err := users.Get(id)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			u = &other
+		}
+	}
+
+	devices, err := deviceStore.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result := []devicePermission{}
+	for i := range devices {
+		actions := devicePermissions(u, &devices[i])
+		if len(actions) == 0 {
+			continue
+		}
+		result = append(result, devicePermission{
+			DeviceID:   devices[i].ID,
+			DeviceName: devices[i].Name,
+			Actions:    actions,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeviceID < result[j].DeviceID })
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":  u.ID,
+		"username": u.Username,
+		"role":     u.Role,
+		"devices":  result,
+	})
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// 批量任务状态
+const (
+	JobRunning     = "running"
+	JobDone        = "done"
+	JobCanceled    = "canceled"
+	JobInterrupted = "interrupted" // 服务重启时任务未完成
+)
+
+// 单台设备的执行状态
+const (
+	JobHostPending  = "pending"
+	JobHostRunning  = "running"
+	JobHostSuccess  = "success" // 退出码为 0
+	JobHostFailed   = "failed"  // 退出码非 0 或连接失败
+	JobHostTimeout  = "timeout"
+	JobHostCanceled = "canceled"
+	JobHostDenied   = "denied" // 没有该设备的权限，未执行
+)
+
+const (
+	jobDefaultConcurrency = 10
+	jobMaxConcurrency     = 50
+	jobDefaultTimeout     = 60 // 秒
+	jobMaxTimeout         = 3600
+	jobOutputLimit        = 1 << 20 // 每台设备保存的输出上限
+	jobListLimit          = 100
+)
+
+// 单台设备的执行结果
+type JobHost struct {
+	DeviceID   int        `json:"device_id"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Output     string     `json:"output,omitempty"` // stdout 和 stderr 按到达顺序合并
+	Truncated  bool       `json:"truncated,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// 批量任务：在选中的设备上并行执行同一条命令
+type Job struct {
+	ID          string      `json:"id"`
+	Command     string      `json:"command"`
+	DeviceIDs   []int       `json:"device_ids,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Concurrency int         `json:"concurrency"`
+	Timeout     int         `json:"timeout"` // 每台设备的超时，秒
+	Status      string      `json:"status"`
+	CreatedBy   string      `json:"created_by"`
+	CreatedByID int         `json:"created_by_id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	FinishedAt  *time.Time  `json:"finished_at,omitempty"`
+	Runbook     *JobRunbook `json:"runbook,omitempty"`
+	ScheduleID  int         `json:"schedule_id,omitempty"` // 由定时任务创建
+	Hosts       []*JobHost  `json:"hosts"`
+}
+
+// 由运行手册渲染出的任务记录手册的版本和参数
+type JobRunbook struct {
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Version int               `json:"version"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// 复制任务，withOutput 为 false 时不含输出
+func (j *Job) clone(withOutput bool) *Job {
+	c := *j
+	c.Hosts = make([]*JobHost, len(j.Hosts))
+	for i, h := range j.Hosts {
+		hc := *h
+		if !withOutput {
+			hc.Output = ""
+		}
+		c.Hosts[i] = &hc
+	}
+	return &c
+}
+
+var errJobNotFound = errors.New("任务不存在")
+
+// 任务推送给订阅者的事件
+type jobEvent struct {
+	Type     string   `json:"type"` // snapshot、output、host、done
+	DeviceID int      `json:"device_id,omitempty"`
+	Data     string   `json:"data,omitempty"`
+	Host     *JobHost `json:"host,omitempty"`
+	Job      *Job     `json:"job,omitempty"`
+}
+
+// 正在执行的任务
+type jobRun struct {
+	mu      sync.Mutex
+	job     *Job
+	cancel  context.CancelFunc
+	subs    map[chan jobEvent]struct{}
+	ip      string
+	saveMu  sync.Mutex
+	devices map[int]*CSMPDevice
+	done    chan struct{} // 任务结束并保存后关闭
+}
+
+// 任务目录，每个任务一个 JSON 文件，执行中的任务同时保存在内存中；
+// 列表使用启动时建立、保存时更新的摘要索引，不再逐个读取包含输出的文件
+type jobManager struct {
+	dir       string
+	mu        sync.Mutex
+	running   map[string]*jobRun
+	summaries map[string]*Job // 不含输出
+}
+
+// 全局任务管理，在 main 中初始化
+var jobs *jobManager
+
+func newJobManager(dir string) (*jobManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	m := &jobManager{dir: dir, running: make(map[string]*jobRun), summaries: make(map[string]*Job)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		job, err := m.load(id)
+		if err != nil {
+			log.Printf("读取任务 %s 失败: %v", id, err)
+			continue
+		}
+		m.summaries[id] = job.clone(false)
+	}
+	// 上次退出时未完成的任务标记为中断
+	for _, job := range m.list() {
+		if job.Status != JobRunning {
+			continue
+		}
+		job, err := m.load(job.ID)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		job.Status, job.FinishedAt = JobInterrupted, &now
+		for _, h := range job.Hosts {
+			if h.Status == JobHostPending || h.Status == JobHostRunning {
+				h.Status, h.Error = JobHostCanceled, "服务重启，任务中断"
+			}
+		}
+		if err := m.save(job); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *jobManager) path(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+func (m *jobManager) save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.path(job.ID), data, 0600); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.summaries[job.ID] = job.clone(false)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *jobManager) load(id string) (*Job, error) {
+	if !recordingIDPattern.MatchString(id) {
+		return nil, errJobNotFound
+	}
+	data, err := os.ReadFile(m.path(id))
+	if os.IsNotExist(err) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("解析任务 %s 失败: %v", id, err)
+	}
+	return &job, nil
+}
+
+// 已保存的任务，不含输出，最新的在前
+func (m *jobManager) list() []*Job {
+	m.mu.Lock()
+	list := make([]*Job, 0, len(m.summaries))
+	for _, job := range m.summaries {
+		list = append(list, job.clone(false))
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// 执行中的任务
+func (m *jobManager) active(id string) *jobRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running[id]
+}
+
+// 当前状态：执行中的任务从内存读取，其余从文件读取
+func (m *jobManager) Get(id string) (*Job, error) {
+	if r := m.active(id); r != nil {
+		return r.snapshot(true), nil
+	}
+	return m.load(id)
+}
+
+// 保存任务并开始执行，devices 为有权限执行的设备
+func (m *jobManager) Start(job *Job, devices map[int]*CSMPDevice, ip string) (*jobRun, error) {
+	if err := m.save(job); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &jobRun{job: job, cancel: cancel, subs: make(map[chan jobEvent]struct{}), ip: ip, devices: devices, done: make(chan struct{})}
+	m.mu.Lock()
+	m.running[job.ID] = r
+	m.mu.Unlock()
+	go m.run(ctx, r)
+	return r, nil
+}
+
+func (m *jobManager) run(ctx context.Context, r *jobRun) {
+	defer r.cancel()
+	sem := make(chan struct{}, r.job.Concurrency)
+	var wg sync.WaitGroup
+	for _, host := range r.job.Hosts {
+		r.mu.Lock()
+		pending := host.Status == JobHostPending
+		r.mu.Unlock()
+		if !pending {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			r.finishHost(host, JobHostCanceled, nil, "任务已取消")
+			m.saveRun(r)
+			continue
+		}
+		wg.Add(1)
+		go func(host *JobHost) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.runHost(ctx, host)
+			m.saveRun(r)
+		}(host)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	now := time.Now()
+	r.job.FinishedAt = &now
+	r.job.Status = JobDone
+	if ctx.Err() != nil {
+		r.job.Status = JobCanceled
+	}
+	r.publishLocked(jobEvent{Type: "done", Job: r.job.clone(false)})
+	for ch := range r.subs {
+		delete(r.subs, ch)
+		close(ch)
+	}
+	r.mu.Unlock()
+
+	m.saveRun(r)
+	m.mu.Lock()
+	delete(m.running, r.job.ID)
+	m.mu.Unlock()
+	close(r.done)
+}
+
+// 保存执行中任务的当前状态，同一任务的保存依次进行
+func (m *jobManager) saveRun(r *jobRun) {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	if err := m.save(r.snapshot(true)); err != nil {
+		log.Printf("保存任务 %s 失败: %v", r.job.ID, err)
+	}
+}
+
+// 等待任务结束，返回最终状态
+func (r *jobRun) wait() *Job {
+	<-r.done
+	return r.snapshot(false)
+}
+
+func (r *jobRun) snapshot(withOutput bool) *Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.job.clone(withOutput)
+}
+
+// 发送事件给所有订阅者，跟不上的订阅者被断开，重新订阅时会收到完整快照；调用方需持有锁
+func (r *jobRun) publishLocked(ev jobEvent) {
+	for ch := range r.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(r.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// 订阅任务事件，返回当前快照；任务已结束时返回的 channel 为 nil
+func (r *jobRun) subscribe() (chan jobEvent, *Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snap := r.job.clone(true)
+	if r.job.Status != JobRunning {
+		return nil, snap
+	}
+	ch := make(chan jobEvent, 256)
+	r.subs[ch] = struct{}{}
+	return ch, snap
+}
+
+func (r *jobRun) unsubscribe(ch chan jobEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subs[ch]; ok {
+		delete(r.subs, ch)
+		close(ch)
+	}
+}
+
+func (r *jobRun) hostEventLocked(host *JobHost) {
+	h := *host
+	h.Output = ""
+	r.publishLocked(jobEvent{Type: "host", DeviceID: host.DeviceID, Host: &h})
+}
+
+func (r *jobRun) finishHost(host *JobHost, status string, exitCode *int, errMsg string) {
+	r.mu.Lock()
+	now := time.Now()
+	host.Status, host.ExitCode, host.Error, host.FinishedAt = status, exitCode, errMsg, &now
+	r.hostEventLocked(host)
+	r.mu.Unlock()
+
+	detail := fmt.Sprintf("任务 %s %s", r.job.ID, status)
+	if exitCode != nil {
+		detail += fmt.Sprintf(" 退出码 %d", *exitCode)
+	}
+	if errMsg != "" {
+		detail += " " + errMsg
+	}
+	outcome := AuditSuccess
+	if status != JobHostSuccess {
+		outcome = AuditFailure
+	}
+	r.audit(AuditJobHost, host.DeviceID, outcome, detail)
+}
+
+// 任务在后台执行，以创建者的名义记入审计
+func (r *jobRun) audit(action string, deviceID int, outcome, detail string) {
+	if audit == nil {
+		return
+	}
+	err := audit.Append(AuditEntry{
+		Actor:    r.job.CreatedBy,
+		ActorID:  r.job.CreatedByID,
+		SourceIP: r.ip,
+		Action:   action,
+		DeviceID: deviceID,
+		Outcome:  outcome,
+		Detail:   detail,
+	})
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// 在一台设备上执行命令。命令运行在伪终端中，超时或取消时发送 KILL 信号并关闭会话，
+// 伪终端关闭后设备向命令所在的进程组发送 SIGHUP；很多 sshd 忽略 signal 请求，
+// 忽略 SIGHUP 的命令仍可能继续运行，因此终止只是尽力而为
+func (r *jobRun) runHost(ctx context.Context, host *JobHost) {
+	r.mu.Lock()
+	now := time.Now()
+	host.Status, host.StartedAt = JobHostRunning, &now
+	r.hostEventLocked(host)
+	r.mu.Unlock()
+
+	session, release, err := sshClients.Session(r.devices[host.DeviceID])
+	if err != nil {
+		r.finishHost(host, JobHostFailed, nil, "SSH连接失败: "+err.Error())
+		return
+	}
+	defer release()
+	// 不回显、不把换行转换为 \r\n，输出与不使用伪终端时一致
+	modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.ONLCR: 0}
+	if err := session.RequestPty("dumb", 24, 200, modes); err != nil {
+		r.finishHost(host, JobHostFailed, nil, "请求伪终端失败: "+err.Error())
+		return
+	}
+	session.Stdout = &jobOutput{run: r, host: host}
+	session.Stderr = &jobOutput{run: r, host: host}
+	if err := session.Start(r.job.Command); err != nil {
+		r.finishHost(host, JobHostFailed, nil, "启动命令失败: "+err.Error())
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	hostCtx, cancel := context.WithTimeout(ctx, time.Duration(r.job.Timeout)*time.Second)
+	defer cancel()
+	select {
+	case err = <-done:
+	case <-hostCtx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		if ctx.Err() != nil {
+			r.finishHost(host, JobHostCanceled, nil, "任务已取消，已尝试终止设备上的命令，不保证已停止")
+		} else {
+			r.finishHost(host, JobHostTimeout, nil, fmt.Sprintf("超过 %d 秒未完成，已尝试终止设备上的命令，不保证已停止", r.job.Timeout))
+		}
+		return
+	}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		code := 0
+		r.finishHost(host, JobHostSuccess, &code, "")
+	case errors.As(err, &exitErr):
+		code := exitErr.ExitStatus()
+		r.finishHost(host, JobHostFailed, &code, "")
+	default:
+		r.finishHost(host, JobHostFailed, nil, err.Error())
+	}
+}
+
+// 收集一台设备的输出并推送给订阅者，stdout 和 stderr 各用一个
+type jobOutput struct {
+	run     *jobRun
+	host    *JobHost
+	pending []byte // 读取可能在多字节字符中间截断，不完整的尾部留到下次
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	buf := append(o.pending, p...)
+	cut := utf8CompleteLen(buf)
+	o.pending = append([]byte(nil), buf[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+	data := string(buf[:cut])
+
+	r := o.run
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if room := jobOutputLimit - len(o.host.Output); room < len(data) {
+		o.host.Output += data[:utf8CompleteLen([]byte(data[:max(room, 0)]))]
+		o.host.Truncated = true
+	} else {
+		o.host.Output += data
+	}
+	r.publishLocked(jobEvent{Type: "output", DeviceID: o.host.DeviceID, Data: data})
+	return len(p), nil
+}
+
+// 取消任务，正在执行的命令被终止，未开始的设备不再执行
+func (m *jobManager) Cancel(id string) bool {
+	r := m.active(id)
+	if r == nil {
+		return false
+	}
+	r.cancel()
+	return true
+}
+
+// 创建任务请求，device_ids 和 tags 选中的设备取并集，标签 * 表示所有设备
+type createJobRequest struct {
+	Command     string   `json:"command"`
+	DeviceIDs   []int    `json:"device_ids"`
+	Tags        []string `json:"tags"`
+	Concurrency int      `json:"concurrency"`
+	Timeout     int      `json:"timeout"`
+}
+
+// 按设备ID和标签选择设备
+func selectJobDevices(req createJobRequest) ([]CSMPDevice, error) {
+	all, err := deviceStore.List()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int]bool)
+	for _, dev := range all {
+		known[dev.ID] = true
+	}
+	byID := make(map[int]bool)
+	for _, id := range req.DeviceIDs {
+		if !known[id] {
+			return nil, fmt.Errorf("设备 %d 不存在", id)
+		}
+		byID[id] = true
+	}
+	var selected []CSMPDevice
+	for _, dev := range all {
+		match := byID[dev.ID]
+		for _, tag := range req.Tags {
+			if (Grant{Tag: tag}).matches(&dev) {
+				match = true
+			}
+		}
+		if match {
+			selected = append(selected, dev)
+		}
+	}
+	return selected, nil
+}
+
+// 批量任务接口
+func createJob(c *gin.Context) {
+	var req createJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Command = strings.TrimSpace(req.Command)
+	if req.Command == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少命令"})
+		return
+	}
+	if job, ok := startJob(c, req, nil); ok {
+		c.JSON(http.StatusCreated, job)
+	}
+}
+
+// 任务请求参数错误，与保存任务等内部错误区分开
+type jobRequestError struct {
+	err error
+}
+
+func (e *jobRequestError) Error() string { return e.err.Error() }
+
+// 以 user 的权限准备任务：执行命令等同于打开 WebShell，没有权限或 SSH 配置不完整的设备不执行；
+// 返回任务、可以执行的设备和没有权限的设备
+func prepareJob(user *User, req createJobRequest, runbook *JobRunbook) (*Job, map[int]*CSMPDevice, []int, error) {
+	if req.Concurrency <= 0 {
+		req.Concurrency = jobDefaultConcurrency
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = jobDefaultTimeout
+	}
+	if req.Concurrency > jobMaxConcurrency || req.Timeout > jobMaxTimeout {
+		return nil, nil, nil, &jobRequestError{fmt.Errorf("并发数不能超过 %d，超时不能超过 %d 秒", jobMaxConcurrency, jobMaxTimeout)}
+	}
+	selected, err := selectJobDevices(req)
+	if err != nil {
+		return nil, nil, nil, &jobRequestError{err}
+	}
+	if len(selected) == 0 {
+		return nil, nil, nil, &jobRequestError{errors.New("没有选中任何设备")}
+	}
+
+	now := time.Now().UTC()
+	id, err := timestampID(now)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	job := &Job{
+		ID:          id,
+		Command:     req.Command,
+		DeviceIDs:   req.DeviceIDs,
+		Tags:        req.Tags,
+		Concurrency: req.Concurrency,
+		Timeout:     req.Timeout,
+		Status:      JobRunning,
+		CreatedBy:   user.Username,
+		CreatedByID: user.ID,
+		CreatedAt:   now,
+		Runbook:     runbook,
+	}
+	devices := make(map[int]*CSMPDevice)
+	var denied []int
+	for i := range selected {
+		dev := &selected[i]
+		host := &JobHost{DeviceID: dev.ID, Name: dev.Name, Status: JobHostPending}
+		switch {
+		case !deviceAllowed(user, dev, ActionWebShell):
+			host.Status, host.Error = JobHostDenied, "没有该设备的操作权限"
+			denied = append(denied, dev.ID)
+		case dev.SSHHost == "" || dev.SSHUser == "" || !deviceHasSSHCredentials(dev):
+			host.Status, host.Error = JobHostFailed, "设备SSH配置不完整"
+		default:
+			devices[dev.ID] = dev
+		}
+		job.Hosts = append(job.Hosts, host)
+	}
+	return job, devices, denied, nil
+}
+
+// 审计日志中任务的说明
+func (j *Job) auditDetail(devices int) string {
+	if j.Runbook != nil {
+		return fmt.Sprintf("任务 %s %d 台设备 运行手册 %s v%d: %s", j.ID, devices, j.Runbook.Name, j.Runbook.Version, j.Command)
+	}
+	return fmt.Sprintf("任务 %s %d 台设备: %s", j.ID, devices, j.Command)
+}
+
+// 校验请求并开始执行任务，失败时写入错误响应；runbook 为运行手册渲染出的任务的来源
+func startJob(c *gin.Context, req createJobRequest, runbook *JobRunbook) (*Job, bool) {
+	job, devices, denied, err := prepareJob(currentUser(c), req, runbook)
+	var reqErr *jobRequestError
+	if errors.As(err, &reqErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	for _, id := range denied {
+		recordAudit(c, AuditAccessDenied, id, "", AuditDenied, ActionWebShell+" 任务 "+job.ID)
+	}
+	resp := job.clone(false)
+	if _, err := jobs.Start(job, devices, c.ClientIP()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	recordAudit(c, AuditJobRun, 0, "", AuditSuccess, job.auditDetail(len(devices)))
+	return resp, true
+}
+
+// 只有任务创建者和管理员可以查看和取消任务
+func jobForRequest(c *gin.Context) (*Job, bool) {
+	job, err := jobs.Get(c.Param("id"))
+	if err == errJobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	user := currentUser(c)
+	if job.CreatedByID != user.ID && !roleAtLeast(user.Role, RoleAdmin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errJobNotFound.Error()})
+		return nil, false
+	}
+	return job, true
+}
+
+func listJobs(c *gin.Context) {
+	list := jobs.list()
+	limit := jobListLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	user := currentUser(c)
+	result := []*Job{}
+	for _, job := range list {
+		if len(result) >= limit {
+			break
+		}
+		if job.CreatedByID == user.ID || roleAtLeast(user.Role, RoleAdmin) {
+			result = append(result, job)
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func getJob(c *gin.Context) {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func cancelJob(c *gin.Context) {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return
+	}
+	if !jobs.Cancel(job.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "任务已结束"})
+		return
+	}
+	recordAudit(c, AuditJobCancel, 0, "", AuditSuccess, "任务 "+job.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "任务已取消"})
+}
+
+// 以 SSE 推送任务进度：先发送包含已有输出的 snapshot，再实时发送 output、host 事件，结束时发送 done
+func jobEvents(c *gin.Context) {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return
+	}
+	var ch chan jobEvent
+	if r := jobs.active(job.ID); r != nil {
+		ch, job = r.subscribe()
+		if ch != nil {
+			defer r.unsubscribe(ch)
+		}
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("snapshot", jobEvent{Type: "snapshot", Job: job})
+	if ch == nil {
+		c.SSEvent("done", jobEvent{Type: "done", Job: job.clone(false)})
+		return
+	}
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent(ev.Type, ev)
+			return ev.Type != "done"
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
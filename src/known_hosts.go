@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// 主机密钥校验策略
+const (
+	HostKeyTOFU   = "tofu"   // 首次连接时记录密钥，之后密钥变化则拒绝
+	HostKeyStrict = "strict" // 未记录的主机也拒绝，需要管理员先接受密钥
+)
+
+// 当前使用的主机密钥策略，在 main 中根据启动参数设置
+var hostKeyPolicy = HostKeyTOFU
+
+// 设备 SSH 地址已固定的主机密钥
+type KnownHost struct {
+	DeviceID    int       `json:"device_id"`
+	Address     string    `json:"address"`
+	KeyType     string    `json:"key_type,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	PublicKey   string    `json:"public_key,omitempty"`
+	FirstSeen   time.Time `json:"first_seen,omitempty"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+
+	// 最近一次被拒绝的密钥，管理员确认后可以接受
+	PendingKeyType     string     `json:"pending_key_type,omitempty"`
+	PendingFingerprint string     `json:"pending_fingerprint,omitempty"`
+	PendingPublicKey   string     `json:"pending_public_key,omitempty"`
+	PendingSeenAt      *time.Time `json:"pending_seen_at,omitempty"`
+}
+
+// 主机密钥与记录不一致
+type HostKeyMismatchError struct {
+	DeviceID int
+	Address  string
+	Expected string
+	Got      string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("%s 的主机密钥已变化（记录 %s，实际 %s），可能存在中间人攻击，请管理员核实后接受新密钥", e.Address, e.Expected, e.Got)
+}
+
+// 严格模式下主机密钥未被接受
+type HostKeyUnknownError struct {
+	DeviceID int
+	Address  string
+	Got      string
+}
+
+func (e *HostKeyUnknownError) Error() string {
+	return fmt.Sprintf("%s 的主机密钥 %s 尚未被接受，请管理员核实后接受", e.Address, e.Got)
+}
+
+var errKnownHostNotFound = errors.New("没有待接受的主机密钥")
+
+// 主机密钥存储，保存在 JSON 文件中
+type knownHostStore struct {
+	mu    sync.Mutex
+	path  string
+	hosts []KnownHost
+}
+
+// 全局主机密钥存储，在 main 中初始化
+var knownHosts *knownHostStore
+
+func newKnownHostStore(path string) (*knownHostStore, error) {
+	s := &knownHostStore{path: path, hosts: []KnownHost{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.hosts); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	return s, nil
+}
+
+// 保存主机密钥到文件，调用方需持有锁
+func (s *knownHostStore) save() error {
+	data, err := json.MarshalIndent(s.hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// 查找设备某个地址的记录，调用方需持有锁
+func (s *knownHostStore) find(deviceID int, address string) *KnownHost {
+	for i := range s.hosts {
+		if s.hosts[i].DeviceID == deviceID && s.hosts[i].Address == address {
+			return &s.hosts[i]
+		}
+	}
+	return nil
+}
+
+// 校验主机密钥：未记录时按策略记录或拒绝，已记录时必须一致
+func (s *knownHostStore) Check(deviceID int, address string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.find(deviceID, address)
+	if h != nil && h.Fingerprint == fingerprint {
+		h.LastSeen = now
+		return nil
+	}
+	if h == nil {
+		s.hosts = append(s.hosts, KnownHost{DeviceID: deviceID, Address: address})
+		h = &s.hosts[len(s.hosts)-1]
+	}
+
+	if h.Fingerprint == "" && hostKeyPolicy == HostKeyTOFU {
+		h.KeyType = key.Type()
+		h.Fingerprint = fingerprint
+		h.PublicKey = base64.StdEncoding.EncodeToString(key.Marshal())
+		h.FirstSeen = now
+		h.LastSeen = now
+		return s.save()
+	}
+
+	// 记录被拒绝的密钥，供管理员查看和接受
+	h.PendingKeyType = key.Type()
+	h.PendingFingerprint = fingerprint
+	h.PendingPublicKey = base64.StdEncoding.EncodeToString(key.Marshal())
+	h.PendingSeenAt = &now
+	if err := s.save(); err != nil {
+		return err
+	}
+	if h.Fingerprint == "" {
+		return &HostKeyUnknownError{DeviceID: deviceID, Address: address, Got: fingerprint}
+	}
+	return &HostKeyMismatchError{DeviceID: deviceID, Address: address, Expected: h.Fingerprint, Got: fingerprint}
+}
+
+func (s *knownHostStore) ForDevice(deviceID int) []KnownHost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []KnownHost{}
+	for _, h := range s.hosts {
+		if h.DeviceID == deviceID {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// 接受待确认的密钥，fingerprint 必须与待确认的密钥一致，防止接受到未核实的密钥
+func (s *knownHostStore) Accept(deviceID int, fingerprint string) (KnownHost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.hosts {
+		h := &s.hosts[i]
+		if h.DeviceID != deviceID || h.PendingFingerprint == "" || h.PendingFingerprint != fingerprint {
+			continue
+		}
+		old := *h
+		now := time.Now()
+		h.KeyType = h.PendingKeyType
+		h.Fingerprint = h.PendingFingerprint
+		h.PublicKey = h.PendingPublicKey
+		h.FirstSeen = now
+		h.LastSeen = now
+		h.PendingKeyType = ""
+		h.PendingFingerprint = ""
+		h.PendingPublicKey = ""
+		h.PendingSeenAt = nil
+		if err := s.save(); err != nil {
+			*h = old
+			return KnownHost{}, err
+		}
+		return *h, nil
+	}
+	return KnownHost{}, errKnownHostNotFound
+}
+
+// 删除设备的全部主机密钥记录
+func (s *knownHostStore) DeleteDevice(deviceID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []KnownHost{}
+	for _, h := range s.hosts {
+		if h.DeviceID != deviceID {
+			kept = append(kept, h)
+		}
+	}
+	n := len(s.hosts) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	old := s.hosts
+	s.hosts = kept
+	if err := s.save(); err != nil {
+		s.hosts = old
+		return 0, err
+	}
+	return n, nil
+}
+
+// 设备的主机密钥校验回调
+func deviceHostKeyCallback(dev *CSMPDevice) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return knownHosts.Check(dev.ID, hostname, key)
+	}
+}
+
+// 主机密钥校验失败时写入 409 响应，其他错误返回 false 由调用方处理
+func writeHostKeyError(c *gin.Context, err error) bool {
+	var mismatch *HostKeyMismatchError
+	var unknown *HostKeyUnknownError
+	switch {
+	case errors.As(err, &mismatch):
+		recordAudit(c, AuditHostKeyMismatch, mismatch.DeviceID, "", AuditDenied, mismatch.Error())
+		c.JSON(http.StatusConflict, gin.H{"error": mismatch.Error(), "host_key_mismatch": true, "expected": mismatch.Expected, "got": mismatch.Got})
+	case errors.As(err, &unknown):
+		recordAudit(c, AuditHostKeyMismatch, unknown.DeviceID, "", AuditDenied, unknown.Error())
+		c.JSON(http.StatusConflict, gin.H{"error": unknown.Error(), "host_key_unknown": true, "got": unknown.Got})
+	default:
+		return false
+	}
+	return true
+}
+
+// 主机密钥管理接口
+func getHostKeys(c *gin.Context) {
+	dev, ok := lookupDevice(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": hostKeyPolicy, "hosts": knownHosts.ForDevice(dev.ID)})
+}
+
+func acceptHostKey(c *gin.Context) {
+	dev, ok := lookupDevice(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	var req struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h, err := knownHosts.Accept(dev.ID, req.Fingerprint)
+	if err == errKnownHostNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditHostKeyAccept, dev.ID, "", AuditSuccess, h.Address+" "+h.Fingerprint)
+	c.JSON(http.StatusOK, h)
+}
+
+func resetHostKeys(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
+		return
+	}
+	n, err := knownHosts.DeleteDevice(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditHostKeyReset, id, "", AuditSuccess, "")
+	c.JSON(http.StatusOK, gin.H{"message": "主机密钥已重置", "deleted": n})
+}
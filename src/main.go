@@ -1,12 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -25,77 +26,219 @@ type CSMPDevice struct {
 	SSHUser   string   `json:"ssh_user"`
 	SSHPass   string   `json:"ssh_pass"`
 	VNCPass   string   `json:"vnc_pass"`
+	Tags      []string `json:"tags"`
 	TimeStamp string   `json:"time_stamp"`
 	Count     int      `json:"count"`
 	VM        []VMItem `json:"vm"`
-}
 
-// 执行请求结构
-type ExecuteRequest struct {
-	ConfigID int    `json:"config_id"`
-	ItemID   string `json:"item_id"`
-	Command  string `json:"command"`
+	// SSH 认证方式: password（默认）、key、agent、cert
+	SSHAuthType      string `json:"ssh_auth_type,omitempty"`
+	SSHKey           string `json:"ssh_key,omitempty"`            // PEM 格式私钥
+	SSHKeyPassphrase string `json:"ssh_key_passphrase,omitempty"` // 私钥口令
+	SSHCert          string `json:"ssh_cert,omitempty"`           // OpenSSH 用户证书，authorized_keys 格式
+	SSHAgentSocket   string `json:"ssh_agent_socket,omitempty"`   // ssh-agent 套接字，默认 SSH_AUTH_SOCK
+
+	// VNC 经设备的 SSH 连接转发到 127.0.0.1，VNC 只需监听本地地址
+	VNCViaSSH bool `json:"vnc_via_ssh,omitempty"`
+
+	// 跳板机链，按顺序逐级连接，为空时直接连接设备
+	JumpHosts []JumpHost `json:"jump_hosts,omitempty"`
 }
 
-// 全局变量
-var csmpDevices []CSMPDevice
-var configFile = "devices.json"
+func main() {
+	storeKind := flag.String("store", "file", "设备存储类型: file 或 bolt")
+	storePath := flag.String("store-path", "", "设备存储路径，默认 devices.json 或 devices.db")
+	masterKeyFile := flag.String("master-key-file", "", "主密钥文件，未指定时读取环境变量 "+masterKeyEnv)
+	rotateKey := flag.Bool("rotate-key", false, "用 -new-master-key-file 中的新主密钥重新加密所有设备后退出")
+	newMasterKeyFile := flag.String("new-master-key-file", "", "密钥轮换使用的新主密钥文件")
+	usersFile := flag.String("users", "users.json", "用户账号文件")
+	grantsFile := flag.String("grants", "grants.json", "设备授权文件")
+	tokensFile := flag.String("tokens", "tokens.json", "API 令牌文件")
+	ldapConfigFile := flag.String("ldap-config", "", "LDAP 认证配置文件，未指定时只使用本地账号")
+	flag.BoolVar(&mfaPolicy.WebShell, "mfa-webshell", false, "打开 WebShell 前要求完成两步验证")
+	flag.BoolVar(&mfaPolicy.DeviceEdit, "mfa-device-edit", false, "修改设备凭据前要求完成两步验证")
+	flag.DurationVar(&mfaPolicy.Fresh, "mfa-fresh", 5*time.Minute, "两步验证的有效时长")
+	knownHostsFile := flag.String("known-hosts", "known_hosts.json", "设备 SSH 主机密钥文件")
+	flag.StringVar(&hostKeyPolicy, "host-key-policy", HostKeyTOFU, "主机密钥策略: tofu（首次连接时记录）或 strict（需管理员接受）")
+	sshIdle := flag.Duration("ssh-idle-timeout", 5*time.Minute, "SSH 连接池中空闲连接的保留时长")
+	sshKeepalive := flag.Duration("ssh-keepalive", 30*time.Second, "SSH 连接池保活间隔")
+	auditFile := flag.String("audit-log", "audit.log", "审计日志文件")
+	auditVerify := flag.Bool("audit-verify", false, "校验审计日志的哈希链后退出")
+	jobsDir := flag.String("jobs-dir", "jobs", "批量任务结果目录")
+	runbooksFile := flag.String("runbooks", "runbooks.json", "运行手册文件")
+	schedulesFile := flag.String("schedules", "schedules.json", "定时任务文件")
+	scheduleWebhook := flag.String("schedule-webhook", "", "定时任务执行失败时以 JSON POST 通知的地址")
+	flag.StringVar(&forwardListenHost, "forward-listen", "", "监听方式的端口转发绑定的地址，如 0.0.0.0，为空时只允许 websocket 方式")
+	recordDir := flag.String("record-dir", "recordings", "会话录像目录")
+	recordRetention := flag.Duration("record-retention", 0, "录像保留时长，超过后自动删除，0 表示永久保留")
+	flag.BoolVar(&recordVNC, "vnc-record", false, "录制 VNC 会话")
+	flag.BoolVar(&recordWebShell, "webshell-record", false, "以 asciicast v2 格式录制 WebShell 会话")
+	flag.BoolVar(&recordWebShellInput, "webshell-record-input", false, "WebShell 录像同时记录键盘输入（可能包含输入的密码）")
+	flag.DurationVar(&webShellGrace, "webshell-grace", webShellGrace, "WebShell 浏览器断开后会话的保留时长，0 表示立即结束")
+	flag.IntVar(&webShellScrollback, "webshell-scrollback", webShellScrollback, "WebShell 会话保留的最近输出字节数，重新连接时回放")
+	origins := flag.String("allowed-origins", "", "允许跨域访问的来源，逗号分隔，默认只允许同源")
+	trustedProxies := flag.String("trusted-proxies", "", "可信反向代理的地址或网段，逗号分隔；只有来自这些地址的请求才按 X-Forwarded-For 取客户端地址")
+	flag.Parse()
+	// 连接池的保活协程按这两个间隔定时，必须大于 0
+	if *sshKeepalive <= 0 || *sshIdle <= 0 {
+		fmt.Println("-ssh-keepalive 和 -ssh-idle-timeout 必须大于 0")
+		flag.Usage()
+		os.Exit(2)
+	}
 
-// 加载配置文件
-func loadDeviceInfos() error {
-	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		// 如果文件不存在，创建默认配置
-		csmpDevices = []CSMPDevice{}
-		return saveDeviceInfos()
+	if *auditVerify {
+		last, err := verifyAuditLog(*auditFile)
+		if err != nil {
+			fmt.Printf("审计日志校验失败: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("审计日志完整，共 %d 条记录\n", last.Seq)
+		return
 	}
 
-	data, err := ioutil.ReadFile(configFile)
+	// 打开设备存储
+	store, err := openDeviceStore(*storeKind, *storePath)
 	if err != nil {
-		return err
+		fmt.Printf("打开设备存储失败: %v\n", err)
+		os.Exit(1)
 	}
+	defer store.Close()
 
-	return json.Unmarshal(data, &csmpDevices)
-}
-
-// 保存配置到文件
-func saveDeviceInfos() error {
-	data, err := json.MarshalIndent(csmpDevices, "", "  ")
+	var box *secretBox
+	masterKey, err := loadMasterKey(*masterKeyFile)
+	if err == nil && masterKey != nil {
+		box, err = newSecretBox(masterKey)
+	}
 	if err != nil {
-		return err
+		fmt.Printf("加载主密钥失败: %v\n", err)
+		os.Exit(1)
 	}
-	return ioutil.WriteFile(configFile, data, 0644)
-}
 
-// 获取下一个可用的ID
-func getNextConfigID() int {
-	maxID := 0
-	for _, config := range csmpDevices {
-		if config.ID > maxID {
-			maxID = config.ID
+	if *rotateKey {
+		if err := runRotateKey(store, box, *newMasterKeyFile); err != nil {
+			fmt.Printf("密钥轮换失败: %v\n", err)
+			os.Exit(1)
 		}
+		return
 	}
-	return maxID + 1
-}
 
-func main() {
-	// 加载配置文件
-	if err := loadDeviceInfos(); err != nil {
-		fmt.Printf("加载配置文件失败: %v\n", err)
-		// 继续运行，使用空配置
-		csmpDevices = []CSMPDevice{}
+	deviceStore = store
+	masterBox = box
+	if box != nil {
+		deviceStore, err = newSecretDeviceStore(store, box)
+		if err != nil {
+			fmt.Printf("加密设备信息失败: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("警告: 未配置主密钥，设备密码将以明文保存")
+	}
+
+	// 加载用户账号
+	users, err = newUserStore(*usersFile)
+	if err == nil {
+		err = bootstrapAdmin(users)
+	}
+	if err != nil {
+		fmt.Printf("加载用户失败: %v\n", err)
+		os.Exit(1)
 	}
+	authenticators = []Authenticator{&localAuthenticator{store: users}}
+	if *ldapConfigFile != "" {
+		ldapConfig, err := loadLDAPConfig(*ldapConfigFile)
+		if err != nil {
+			fmt.Printf("加载 LDAP 配置失败: %v\n", err)
+			os.Exit(1)
+		}
+		ldapAuth, err := newLDAPAuthenticator(ldapConfig, users)
+		if err != nil {
+			fmt.Printf("初始化 LDAP 认证失败: %v\n", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, ldapAuth)
+	}
+	if grants, err = newGrantStore(*grantsFile); err != nil {
+		fmt.Printf("加载授权失败: %v\n", err)
+		os.Exit(1)
+	}
+	if tokens, err = newTokenStore(*tokensFile); err != nil {
+		fmt.Printf("加载令牌失败: %v\n", err)
+		os.Exit(1)
+	}
+	if hostKeyPolicy != HostKeyTOFU && hostKeyPolicy != HostKeyStrict {
+		fmt.Printf("未知的主机密钥策略: %s\n", hostKeyPolicy)
+		os.Exit(1)
+	}
+	if knownHosts, err = newKnownHostStore(*knownHostsFile); err != nil {
+		fmt.Printf("加载主机密钥失败: %v\n", err)
+		os.Exit(1)
+	}
+	sshClients = newSSHPool(*sshIdle, *sshKeepalive)
+	stopPool := make(chan struct{})
+	defer close(stopPool)
+	go sshClients.run(stopPool)
+	go sshClients.watchDevices(deviceStore)
+
+	if audit, err = openAuditLog(*auditFile); err != nil {
+		fmt.Printf("打开审计日志失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer audit.Close()
+
+	if recordings, err = newRecordingStore(*recordDir); err != nil {
+		fmt.Printf("创建录像目录失败: %v\n", err)
+		os.Exit(1)
+	}
+	stopRetention := make(chan struct{})
+	defer close(stopRetention)
+	go recordings.runRetention(*recordRetention, stopRetention)
+
+	if jobs, err = newJobManager(*jobsDir); err != nil {
+		fmt.Printf("创建任务目录失败: %v\n", err)
+		os.Exit(1)
+	}
+	if runbooks, err = newRunbookStore(*runbooksFile); err != nil {
+		fmt.Printf("加载运行手册失败: %v\n", err)
+		os.Exit(1)
+	}
+	if schedules, err = newScheduler(*schedulesFile, *scheduleWebhook); err != nil {
+		fmt.Printf("加载定时任务失败: %v\n", err)
+		os.Exit(1)
+	}
+	schedules.Start()
+	defer schedules.Stop()
 
 	gin.SetMode(gin.ReleaseMode) // 可选：减少多余输出
 	r := gin.New()               // 不使用 Default()，避免默认 Logger
 	gin.DefaultWriter = io.Discard
 	gin.DefaultErrorWriter = io.Discard
 
-	// 配置CORS
-	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
-	r.Use(cors.New(config))
+	// 客户端地址用于审计和端口转发的来源限制，默认不信任任何代理头
+	var proxies []string
+	for _, p := range strings.Split(*trustedProxies, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		fmt.Printf("可信代理配置错误: %v\n", err)
+		os.Exit(1)
+	}
+
+	// 配置CORS，只对明确允许的来源开放，并允许携带登录 Cookie
+	for _, o := range strings.Split(*origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowedOrigins = append(allowedOrigins, o)
+		}
+	}
+	if len(allowedOrigins) > 0 {
+		config := cors.DefaultConfig()
+		config.AllowOrigins = allowedOrigins
+		config.AllowCredentials = true
+		config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+		config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+		r.Use(cors.New(config))
+	}
 
 	// 静态文件服务
 	r.Static("/static", "./static")
@@ -108,38 +251,180 @@ func main() {
 
 	r.LoadHTMLGlob("html/*")
 
+	// 登录页
+	r.GET("/login", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "login.html", nil)
+	})
+	r.POST("/api/auth/login", login)
+	r.POST("/api/auth/logout", logout)
+
 	// 主页
-	r.GET("/", func(c *gin.Context) {
+	r.GET("/", authRequired(), func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
 
-	// API 路由
-	api := r.Group("/api")
+	// API 路由，均需登录
+	api := r.Group("/api", authRequired())
 	{
+		api.GET("/auth/me", getMe)
+		api.PUT("/auth/password", changeOwnPassword)
+
+		// 两步验证
+		api.GET("/auth/totp", getTOTPStatus)
+		api.POST("/auth/totp/enroll", enrollTOTP)
+		api.POST("/auth/totp/confirm", confirmTOTP)
+		api.POST("/auth/totp/disable", disableTOTP)
+		api.POST("/auth/step-up", stepUp)
+
 		// CSMP设备管理
 		api.GET("/devices", getDevices)
-		api.POST("/devices", createDevice)
-		api.PUT("/devices/:id", updateDevice)
-		api.DELETE("/devices/:id", deleteConfig)
+		api.POST("/devices", requireRole(RoleAdmin), requireUnscoped(), createDevice)
+		api.PUT("/devices/:id", requireRole(RoleAdmin), requireDeviceScope(), updateDevice)
+		api.DELETE("/devices/:id", requireRole(RoleAdmin), requireDeviceScope(), deleteConfig)
+
+		// 设备 SSH 主机密钥
+		api.GET("/devices/:id/hostkey", requireRole(RoleAdmin), requireDeviceScope(), getHostKeys)
+		api.POST("/devices/:id/hostkey/accept", requireRole(RoleAdmin), requireDeviceScope(), acceptHostKey)
+		api.DELETE("/devices/:id/hostkey", requireRole(RoleAdmin), requireDeviceScope(), resetHostKeys)
 
 		//刷新csmp下对应的虚拟机信息
-		api.GET("/csmp/:id", flushVM)
+		api.GET("/csmp/:id", requireRole(RoleOperator), flushVM)
 
-		api.GET("/webshell", func(c *gin.Context) {
+		api.GET("/webshell", requireRole(RoleOperator), func(c *gin.Context) {
 			c.HTML(http.StatusOK, "webshell.html", nil)
 		})
 
 		// WebShell WebSocket API
-		api.GET("/webshell/ws", handleWebShellWebSocket)
+		api.GET("/webshell/ws", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), handleWebShellWebSocket)
+
+		// WebShell 会话共享和恢复，由会话所有者管理
+		api.GET("/webshell/sessions", requireRole(RoleOperator), listWebShellSessions)
+		api.GET("/webshell/sessions/:id", requireRole(RoleOperator), getWebShellSession)
+		api.DELETE("/webshell/sessions/:id", requireRole(RoleOperator), closeWebShellSession)
+		api.POST("/webshell/sessions/:id/shares", requireRole(RoleOperator), createWebShellShare)
+		api.DELETE("/webshell/sessions/:id/shares/:token", requireRole(RoleOperator), revokeWebShellShare)
+		api.DELETE("/webshell/sessions/:id/participants/:client", requireRole(RoleOperator), kickWebShellParticipant)
+
+		// 设备文件浏览和传输
+		api.GET("/sftp", requireRole(RoleOperator), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "sftp.html", nil)
+		})
+		// 写操作以设备的 SSH 用户身份修改文件，与 WebShell 一样需要两步验证
+		api.GET("/devices/:id/sftp/list", requireRole(RoleOperator), sftpList)
+		api.GET("/devices/:id/sftp/stat", requireRole(RoleOperator), sftpStat)
+		api.GET("/devices/:id/sftp/download", requireRole(RoleOperator), sftpDownload)
+		api.POST("/devices/:id/sftp/upload", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), sftpUpload)
+		api.POST("/devices/:id/sftp/mkdir", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), sftpMkdir)
+		api.POST("/devices/:id/sftp/rename", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), sftpRename)
+		api.POST("/devices/:id/sftp/delete", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), sftpDelete)
+		api.POST("/devices/:id/sftp/chmod", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), sftpChmod)
+
+		// 批量任务
+		api.GET("/batch", requireRole(RoleOperator), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "batch.html", nil)
+		})
+		api.GET("/jobs", requireRole(RoleOperator), listJobs)
+		api.POST("/jobs", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), createJob)
+		api.GET("/jobs/:id", requireRole(RoleOperator), getJob)
+		api.GET("/jobs/:id/events", requireRole(RoleOperator), jobEvents)
+		api.POST("/jobs/:id/cancel", requireRole(RoleOperator), cancelJob)
+
+		// 运行手册
+		api.GET("/runbook", requireRole(RoleOperator), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "runbooks.html", nil)
+		})
+		api.GET("/runbooks", requireRole(RoleOperator), listRunbooks)
+		api.POST("/runbooks", requireRole(RoleOperator), createRunbook)
+		api.GET("/runbooks/:id", requireRole(RoleOperator), getRunbook)
+		api.PUT("/runbooks/:id", requireRole(RoleOperator), updateRunbook)
+		api.DELETE("/runbooks/:id", requireRole(RoleAdmin), deleteRunbook)
+		api.POST("/runbooks/:id/render", requireRole(RoleOperator), renderRunbook)
+		api.POST("/runbooks/:id/run", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), runRunbook)
+		api.GET("/runbooks/:id/runs", requireRole(RoleOperator), listRunbookRuns)
+
+		// 定时任务
+		api.GET("/scheduler", requireRole(RoleOperator), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "schedules.html", nil)
+		})
+		// 定时任务以后会执行命令，保存和启用与立即执行一样需要两步验证
+		api.GET("/schedules", requireRole(RoleOperator), listSchedules)
+		api.POST("/schedules", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), createSchedule)
+		api.GET("/schedules/:id", requireRole(RoleOperator), getSchedule)
+		api.PUT("/schedules/:id", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), updateSchedule)
+		api.DELETE("/schedules/:id", requireRole(RoleOperator), deleteSchedule)
+		api.POST("/schedules/:id/enable", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), enableSchedule)
+		api.POST("/schedules/:id/disable", requireRole(RoleOperator), disableSchedule)
+		api.POST("/schedules/:id/run", requireRole(RoleOperator), requireFreshMFA(&mfaPolicy.WebShell), runScheduleNow)
+
+		// 端口转发
+		api.GET("/forward", requireRole(RoleOperator), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "forwards.html", nil)
+		})
+		api.GET("/forwards", requireRole(RoleOperator), listForwards)
+		api.POST("/devices/:id/forwards", requireRole(RoleOperator), createForward)
+		api.DELETE("/forwards/:id", requireRole(RoleOperator), deleteForward)
+		api.GET("/forwards/:id/ws", requireRole(RoleOperator), handleForwardWebSocket)
 
-		// vnc地址
+		// vnc地址，viewer 角色只读
 		api.GET("/vnc/:id", getVNCAddress)
 		api.GET("/vnc", func(c *gin.Context) {
 			c.HTML(http.StatusOK, "vnc.html", nil)
 		})
 		api.GET("/vnc/ws", handleVNCWebSocket)
+
+		// 用户管理
+		api.GET("/users", requireRole(RoleAdmin), requireUnscoped(), listUsers)
+		api.POST("/users", requireRole(RoleAdmin), requireUnscoped(), createUser)
+		api.PUT("/users/:id", requireRole(RoleAdmin), requireUnscoped(), updateUser)
+		api.DELETE("/users/:id", requireRole(RoleAdmin), requireUnscoped(), deleteUser)
+
+		// 设备授权
+		api.GET("/grants", requireRole(RoleAdmin), requireUnscoped(), listGrants)
+		api.POST("/grants", requireRole(RoleAdmin), requireUnscoped(), createGrant)
+		api.DELETE("/grants/:id", requireRole(RoleAdmin), requireUnscoped(), deleteGrant)
+		api.GET("/permissions", getEffectivePermissions)
+
+		// SSH 连接池状态
+		api.GET("/ssh/pool", requireRole(RoleAdmin), requireUnscoped(), getSSHPoolStats)
+
+		// 审计日志
+		api.GET("/audit", requireRole(RoleAdmin), requireUnscoped(), listAudit)
+
+		// 会话录像
+		api.GET("/recordings", requireRole(RoleAdmin), requireUnscoped(), listRecordings)
+		api.GET("/recordings/:id", requireRole(RoleAdmin), requireUnscoped(), getRecording)
+		api.GET("/recordings/:id/download", requireRole(RoleAdmin), requireUnscoped(), downloadRecording)
+		api.GET("/playback", requireRole(RoleAdmin), requireUnscoped(), func(c *gin.Context) {
+			c.HTML(http.StatusOK, "playback.html", nil)
+		})
+
+		// 个人 API 令牌
+		api.GET("/tokens", listTokens)
+		api.POST("/tokens", createToken)
+		api.DELETE("/tokens/:id", revokeToken)
 	}
 
 	fmt.Println("服务器运行在 https://localhost:8080")
 	_ = r.RunTLS(":8080", "server.crt", "server.key")
 }
+
+// 执行密钥轮换命令
+func runRotateKey(store DeviceStore, oldBox *secretBox, newKeyFile string) error {
+	if newKeyFile == "" {
+		return fmt.Errorf("缺少 -new-master-key-file")
+	}
+	newKey, err := loadMasterKey(newKeyFile)
+	if err != nil {
+		return err
+	}
+	newBox, err := newSecretBox(newKey)
+	if err != nil {
+		return err
+	}
+	n, err := rotateMasterKey(store, oldBox, newBox)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("已重新加密 %d 个设备，请改用新主密钥启动服务\n", n)
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 录像类型
+const (
+	RecordingVNC      = "vnc"
+	RecordingWebShell = "webshell"
+)
+
+// 各类录像文件的扩展名
+var recordingExt = map[string]string{
+	RecordingVNC:      ".vncrec",
+	RecordingWebShell: ".cast",
+}
+
+// 会话录像的元数据，与录像文件同名保存为 .json
+type Recording struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	DeviceID  int        `json:"device_id"`
+	VM        string     `json:"vm,omitempty"`
+	UserID    int        `json:"user_id"`
+	User      string     `json:"user"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Size      int64      `json:"size"`
+}
+
+var errRecordingNotFound = errors.New("录像不存在")
+
+// timestampID 生成的ID格式
+var recordingIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}-[0-9a-f]{8}$`)
+
+// 录像目录，每个会话一个录像文件和一个元数据文件
+type recordingStore struct {
+	dir    string
+	mu     sync.Mutex
+	active map[string]bool // 正在录制的录像
+}
+
+// 全局录像存储，在 main 中初始化
+var recordings *recordingStore
+
+// 是否录制 VNC 会话，在 main 中根据启动参数设置
+var recordVNC bool
+
+func newRecordingStore(dir string) (*recordingStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &recordingStore{dir: dir, active: make(map[string]bool)}, nil
+}
+
+func (s *recordingStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// 录像文件路径
+func (s *recordingStore) Path(rec Recording) string {
+	return filepath.Join(s.dir, rec.ID+recordingExt[rec.Kind])
+}
+
+// 由时间和随机数组成的ID，按字符串排序即按时间排序
+func timestampID(t time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// 创建录像文件并写入元数据，ID 由开始时间和随机数组成
+func (s *recordingStore) Create(rec Recording) (*os.File, Recording, error) {
+	rec.StartedAt = time.Now().UTC()
+	id, err := timestampID(rec.StartedAt)
+	if err != nil {
+		return nil, rec, err
+	}
+	rec.ID = id
+	f, err := os.OpenFile(s.Path(rec), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, rec, err
+	}
+	if err := s.saveMeta(rec); err != nil {
+		f.Close()
+		os.Remove(s.Path(rec))
+		return nil, rec, err
+	}
+	s.mu.Lock()
+	s.active[rec.ID] = true
+	s.mu.Unlock()
+	return f, rec, nil
+}
+
+func (s *recordingStore) saveMeta(rec Recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(rec.ID), data, 0600)
+}
+
+// 会话结束时更新结束时间和大小
+func (s *recordingStore) Finish(rec Recording, size int64) error {
+	s.mu.Lock()
+	delete(s.active, rec.ID)
+	s.mu.Unlock()
+	now := time.Now().UTC()
+	rec.EndedAt = &now
+	rec.Size = size
+	return s.saveMeta(rec)
+}
+
+// 录像最后结束的时间：正常结束的取结束时间；没有结束时间且不在录制中的
+// （服务异常退出时留下的）取录像文件的修改时间；仍在录制的返回 false
+func (s *recordingStore) lastActivity(rec Recording) (time.Time, bool) {
+	if rec.EndedAt != nil {
+		return *rec.EndedAt, true
+	}
+	s.mu.Lock()
+	active := s.active[rec.ID]
+	s.mu.Unlock()
+	if active {
+		return time.Time{}, false
+	}
+	fi, err := os.Stat(s.Path(rec))
+	if err != nil {
+		return rec.StartedAt, true
+	}
+	return fi.ModTime(), true
+}
+
+func (s *recordingStore) Get(id string) (Recording, error) {
+	if !recordingIDPattern.MatchString(id) {
+		return Recording{}, errRecordingNotFound
+	}
+	data, err := os.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return Recording{}, errRecordingNotFound
+	}
+	if err != nil {
+		return Recording{}, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return Recording{}, fmt.Errorf("解析录像 %s 失败: %v", id, err)
+	}
+	return rec, nil
+}
+
+// 录像查询条件，零值表示不限制
+type recordingFilter struct {
+	Kind     string
+	User     string
+	DeviceID int
+	From     time.Time
+	To       time.Time
+	Text     string // 在 WebShell 录像的输入输出中查找
+}
+
+func (f recordingFilter) match(rec Recording) bool {
+	if f.Kind != "" && rec.Kind != f.Kind {
+		return false
+	}
+	if f.User != "" && rec.User != f.User {
+		return false
+	}
+	if f.DeviceID != 0 && rec.DeviceID != f.DeviceID {
+		return false
+	}
+	if !f.From.IsZero() && rec.StartedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && rec.StartedAt.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// 按条件列出录像，最新的在前
+func (s *recordingStore) List(f recordingFilter) ([]Recording, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []Recording{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		rec, err := s.Get(id)
+		if err != nil || !f.match(rec) {
+			continue
+		}
+		if f.Text != "" {
+			if rec.Kind != RecordingWebShell {
+				continue
+			}
+			if found, err := castContains(s.Path(rec), f.Text); err != nil || !found {
+				continue
+			}
+		}
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list, nil
+}
+
+// 删除录像文件和元数据
+func (s *recordingStore) Delete(rec Recording) error {
+	if err := os.Remove(s.Path(rec)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.metaPath(rec.ID))
+}
+
+// 删除结束时间早于 maxAge 之前的录像（包括异常退出后未结束的录像），返回删除的数量
+func (s *recordingStore) Prune(maxAge time.Duration) (int, error) {
+	list, err := s.List(recordingFilter{})
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(-maxAge)
+	n := 0
+	for _, rec := range list {
+		if last, ok := s.lastActivity(rec); !ok || last.After(deadline) {
+			continue
+		}
+		if err := s.Delete(rec); err != nil {
+			log.Printf("删除过期录像 %s 失败: %v", rec.ID, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// 定期按保留期限清理录像，maxAge 为 0 时不清理，stop 关闭时退出
+func (s *recordingStore) runRetention(maxAge time.Duration, stop <-chan struct{}) {
+	if maxAge <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := s.Prune(maxAge); err != nil {
+			log.Printf("清理过期录像失败: %v", err)
+		} else if n > 0 {
+			log.Printf("已清理 %d 个过期录像", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 录像管理接口
+func listRecordings(c *gin.Context) {
+	f := recordingFilter{Kind: c.Query("kind"), User: c.Query("user"), Text: c.Query("q")}
+	var err error
+	if v := c.Query("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from 时间格式错误"})
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to 时间格式错误"})
+			return
+		}
+	}
+	if v := c.Query("device_id"); v != "" {
+		if f.DeviceID, err = strconv.Atoi(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "device_id 错误"})
+			return
+		}
+	}
+	list, err := recordings.List(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getRecording(c *gin.Context) {
+	rec, err := recordings.Get(c.Param("id"))
+	if err == errRecordingNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// 下载录像文件，查看录像本身也记入审计
+func downloadRecording(c *gin.Context) {
+	rec, err := recordings.Get(c.Param("id"))
+	if err == errRecordingNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditRecordingView, rec.DeviceID, rec.VM, AuditSuccess, rec.Kind+" "+rec.ID)
+	c.FileAttachment(recordings.Path(rec), rec.ID+recordingExt[rec.Kind])
+}
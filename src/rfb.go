@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RFB 客户端消息类型
+const (
+	rfbSetPixelFormat           = 0
+	rfbSetEncodings             = 2
+	rfbFramebufferUpdateRequest = 3
+	rfbKeyEvent                 = 4
+	rfbPointerEvent             = 5
+	rfbClientCutText            = 6
+	rfbEnableContinuousUpdates  = 150
+	rfbClientFence              = 248
+	rfbXvp                      = 250
+	rfbSetDesktopSize           = 251
+	rfbQEMUClientMessage        = 255
+)
+
+// 握手完成后的阶段，握手本身由代理完成
+const (
+	rfbStateClientInit = iota
+	rfbStateMessages
+)
+
+var errRFBUnsupported = errors.New("只读模式不支持的RFB消息")
+
+// 只读模式过滤器：解析浏览器在握手之后发往 VNC 服务器的字节流，
+// ClientInit 和画面请求原样转发，丢弃键盘、鼠标、剪贴板、电源和改变分辨率等输入类消息
+type rfbViewOnlyFilter struct {
+	state int
+	buf   []byte
+}
+
+// 输入一段客户端数据，返回允许转发的部分；遇到无法解析的数据返回错误，调用方应断开连接
+func (f *rfbViewOnlyFilter) Filter(data []byte) ([]byte, error) {
+	f.buf = append(f.buf, data...)
+	var out []byte
+	for {
+		n, allow, err := f.next()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if allow {
+			out = append(out, f.buf[:n]...)
+		}
+		f.buf = f.buf[n:]
+	}
+	return out, nil
+}
+
+// 计算缓冲区中下一条完整消息的长度，数据不足时返回 0
+func (f *rfbViewOnlyFilter) next() (int, bool, error) {
+	buf := f.buf
+	switch f.state {
+	case rfbStateClientInit:
+		if len(buf) < 1 {
+			return 0, false, nil
+		}
+		// 只读用户强制共享桌面，不踢掉其他连接
+		buf[0] = 1
+		f.state = rfbStateMessages
+		return 1, true, nil
+	}
+
+	if len(buf) < 1 {
+		return 0, false, nil
+	}
+	switch buf[0] {
+	case rfbSetPixelFormat:
+		return fixedRFBMessage(buf, 20, true)
+	case rfbSetEncodings:
+		if len(buf) < 4 {
+			return 0, false, nil
+		}
+		return fixedRFBMessage(buf, 4+4*int(binary.BigEndian.Uint16(buf[2:4])), true)
+	case rfbFramebufferUpdateRequest:
+		return fixedRFBMessage(buf, 10, true)
+	case rfbKeyEvent:
+		return fixedRFBMessage(buf, 8, false)
+	case rfbPointerEvent:
+		return fixedRFBMessage(buf, 6, false)
+	case rfbClientCutText:
+		if len(buf) < 8 {
+			return 0, false, nil
+		}
+		// 长度字段的最高位表示扩展剪贴板格式，取绝对值
+		length := int32(binary.BigEndian.Uint32(buf[4:8]))
+		if length < 0 {
+			length = -length
+		}
+		return fixedRFBMessage(buf, 8+int(length), false)
+	case rfbEnableContinuousUpdates:
+		return fixedRFBMessage(buf, 10, true)
+	case rfbClientFence:
+		if len(buf) < 9 {
+			return 0, false, nil
+		}
+		return fixedRFBMessage(buf, 9+int(buf[8]), true)
+	case rfbXvp:
+		return fixedRFBMessage(buf, 4, false)
+	case rfbSetDesktopSize:
+		if len(buf) < 8 {
+			return 0, false, nil
+		}
+		return fixedRFBMessage(buf, 8+16*int(buf[6]), false)
+	case rfbQEMUClientMessage:
+		if len(buf) < 2 {
+			return 0, false, nil
+		}
+		switch buf[1] {
+		case 0: // 扩展键盘事件
+			return fixedRFBMessage(buf, 12, false)
+		case 1: // 音频
+			if len(buf) < 4 {
+				return 0, false, nil
+			}
+			if binary.BigEndian.Uint16(buf[2:4]) == 2 {
+				return fixedRFBMessage(buf, 10, true)
+			}
+			return fixedRFBMessage(buf, 4, true)
+		}
+	}
+	return 0, false, errRFBUnsupported
+}
+
+func fixedRFBMessage(buf []byte, size int, allow bool) (int, bool, error) {
+	if len(buf) < size {
+		return 0, false, nil
+	}
+	return size, allow, nil
+}
+
+// RFB 认证方式
+const (
+	rfbSecurityInvalid = 0
+	rfbSecurityNone    = 1
+	rfbSecurityVNCAuth = 2
+)
+
+// 代理完成两侧握手的时限，超时后断开连接
+const rfbHandshakeTimeout = 15 * time.Second
+
+// 解析版本握手消息，返回协商使用的次版本号：3.4~3.6 按 3.3 处理，高于 3.8 的按 3.8 处理
+func parseRFBVersion(buf []byte) (int, error) {
+	var major, minor int
+	if _, err := fmt.Sscanf(string(buf), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 || minor < 3 {
+		return 0, fmt.Errorf("无法识别的RFB版本: %q", buf)
+	}
+	switch {
+	case minor < 7:
+		return 3, nil
+	case minor > 8:
+		return 8, nil
+	}
+	return minor, nil
+}
+
+func writeRFBVersion(w io.Writer, minor int) error {
+	_, err := fmt.Fprintf(w, "RFB 003.%03d\n", minor)
+	return err
+}
+
+// 读取失败原因字符串
+func readRFBReason(r io.Reader) string {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil || n > 4096 {
+		return ""
+	}
+	reason := make([]byte, n)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return ""
+	}
+	return string(reason)
+}
+
+func writeRFBReason(w io.Writer, reason string) error {
+	buf := make([]byte, 4+len(reason))
+	binary.BigEndian.PutUint32(buf, uint32(len(reason)))
+	copy(buf[4:], reason)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 以客户端身份与 VNC 服务器握手，使用设备保存的密码完成 VNC 认证。
+// 服务器支持无认证时也优先使用密码，避免密码配置错误被掩盖
+func rfbServerHandshake(server io.ReadWriter, password string) error {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		return err
+	}
+	minor, err := parseRFBVersion(buf)
+	if err != nil {
+		return err
+	}
+	if err := writeRFBVersion(server, minor); err != nil {
+		return err
+	}
+
+	var choice byte
+	if minor == 3 {
+		// 3.3 版本由服务器直接指定认证方式
+		var security uint32
+		if err := binary.Read(server, binary.BigEndian, &security); err != nil {
+			return err
+		}
+		if security == rfbSecurityInvalid {
+			return fmt.Errorf("VNC服务器拒绝连接: %s", readRFBReason(server))
+		}
+		if security != rfbSecurityNone && security != rfbSecurityVNCAuth {
+			return fmt.Errorf("VNC服务器的认证方式不受支持: %d", security)
+		}
+		if security == rfbSecurityVNCAuth && password == "" {
+			return errors.New("VNC服务器需要密码，但设备未配置VNC密码")
+		}
+		choice = byte(security)
+	} else {
+		var count [1]byte
+		if _, err := io.ReadFull(server, count[:]); err != nil {
+			return err
+		}
+		if count[0] == 0 {
+			return fmt.Errorf("VNC服务器拒绝连接: %s", readRFBReason(server))
+		}
+		types := make([]byte, count[0])
+		if _, err := io.ReadFull(server, types); err != nil {
+			return err
+		}
+		var hasNone, hasVNCAuth bool
+		for _, t := range types {
+			hasNone = hasNone || t == rfbSecurityNone
+			hasVNCAuth = hasVNCAuth || t == rfbSecurityVNCAuth
+		}
+		switch {
+		case hasVNCAuth && password != "":
+			choice = rfbSecurityVNCAuth
+		case hasNone:
+			choice = rfbSecurityNone
+		case hasVNCAuth:
+			return errors.New("VNC服务器需要密码，但设备未配置VNC密码")
+		default:
+			return fmt.Errorf("VNC服务器的认证方式不受支持: %v", types)
+		}
+		if _, err := server.Write([]byte{choice}); err != nil {
+			return err
+		}
+	}
+
+	if choice == rfbSecurityNone {
+		// 3.8 之前无认证时没有认证结果
+		if minor < 8 {
+			return nil
+		}
+	} else {
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(server, challenge); err != nil {
+			return err
+		}
+		response, err := vncAuthResponse(password, challenge)
+		if err != nil {
+			return err
+		}
+		if _, err := server.Write(response); err != nil {
+			return err
+		}
+	}
+	var result uint32
+	if err := binary.Read(server, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result != 0 {
+		reason := "VNC密码错误"
+		if minor >= 8 {
+			if r := readRFBReason(server); r != "" {
+				reason = r
+			}
+		}
+		return fmt.Errorf("VNC认证失败: %s", reason)
+	}
+	return nil
+}
+
+// 与浏览器交换版本，返回浏览器使用的次版本号
+func rfbBrowserVersion(browser io.ReadWriter) (int, error) {
+	if err := writeRFBVersion(browser, 8); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(browser, buf); err != nil {
+		return 0, err
+	}
+	return parseRFBVersion(buf)
+}
+
+// 以服务器身份与浏览器握手，只提供无认证方式，用户已在平台完成认证
+func rfbBrowserHandshake(browser io.ReadWriter) error {
+	minor, err := rfbBrowserVersion(browser)
+	if err != nil {
+		return err
+	}
+	if minor == 3 {
+		_, err = browser.Write([]byte{0, 0, 0, rfbSecurityNone})
+		return err
+	}
+	if _, err := browser.Write([]byte{1, rfbSecurityNone}); err != nil {
+		return err
+	}
+	var choice [1]byte
+	if _, err := io.ReadFull(browser, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != rfbSecurityNone {
+		return fmt.Errorf("浏览器选择了不支持的认证方式: %d", choice[0])
+	}
+	if minor >= 8 {
+		_, err = browser.Write([]byte{0, 0, 0, 0})
+	}
+	return err
+}
+
+// 连接 VNC 服务器失败时按协议拒绝浏览器，页面可以显示失败原因
+func rfbBrowserReject(browser io.ReadWriter, reason string) error {
+	minor, err := rfbBrowserVersion(browser)
+	if err != nil {
+		return err
+	}
+	if minor == 3 {
+		_, err = browser.Write([]byte{0, 0, 0, rfbSecurityInvalid})
+	} else {
+		_, err = browser.Write([]byte{0})
+	}
+	if err != nil {
+		return err
+	}
+	return writeRFBReason(browser, reason)
+}
+
+// VNC 认证：用密码作为 DES 密钥加密服务器的挑战，密钥每个字节按位反转
+func vncAuthResponse(password string, challenge []byte) ([]byte, error) {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		var r byte
+		for j := 0; j < 8; j++ {
+			r = r<<1 | (b>>j)&1
+		}
+		key[i] = r
+	}
+	block, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(response[i:i+8], challenge[i:i+8])
+	}
+	return response, nil
+}
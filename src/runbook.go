@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 运行手册参数类型
+const (
+	ParamString    = "string"    // 任意单行文本
+	ParamInt       = "int"       // 整数
+	ParamChoice    = "choice"    // 从 choices 中选择
+	ParamVM        = "vm"        // 虚拟机名称
+	ParamInterface = "interface" // 网络接口名称
+)
+
+var (
+	runbookParamNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	runbookPlaceholder      = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]*)\s*\}\}`)
+	vmNamePattern           = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	interfaceNamePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:@-]{0,14}$`)
+)
+
+// 运行手册参数
+type RunbookParam struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label,omitempty"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+}
+
+// 运行手册的一个版本，保存后不再修改
+type RunbookVersion struct {
+	Version     int            `json:"version"`
+	Description string         `json:"description,omitempty"`
+	Script      string         `json:"script"`
+	Params      []RunbookParam `json:"params"`
+	Destructive bool           `json:"destructive,omitempty"` // 执行前需要确认
+	CreatedBy   string         `json:"created_by"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// 运行手册：带参数的命令脚本，每次修改保存为新版本
+type Runbook struct {
+	ID          int              `json:"id"`
+	Name        string           `json:"name"`
+	CreatedBy   string           `json:"created_by"`
+	CreatedByID int              `json:"created_by_id,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Versions    []RunbookVersion `json:"versions"` // 按版本号递增
+}
+
+func (rb *Runbook) latest() *RunbookVersion {
+	return &rb.Versions[len(rb.Versions)-1]
+}
+
+// 指定版本，0 表示最新版本
+func (rb *Runbook) version(v int) (*RunbookVersion, bool) {
+	if v == 0 {
+		return rb.latest(), true
+	}
+	for i := range rb.Versions {
+		if rb.Versions[i].Version == v {
+			return &rb.Versions[i], true
+		}
+	}
+	return nil, false
+}
+
+var errRunbookNotFound = errors.New("运行手册不存在")
+
+func validateRunbookVersion(v *RunbookVersion) error {
+	if strings.TrimSpace(v.Script) == "" {
+		return errors.New("缺少脚本")
+	}
+	declared := make(map[string]bool)
+	for i := range v.Params {
+		p := &v.Params[i]
+		if !runbookParamNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("参数名 %q 只能包含小写字母、数字和下划线", p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("参数 %s 重复", p.Name)
+		}
+		declared[p.Name] = true
+		if p.Type == "" {
+			p.Type = ParamString
+		}
+		switch p.Type {
+		case ParamString, ParamInt, ParamVM, ParamInterface:
+		case ParamChoice:
+			if len(p.Choices) == 0 {
+				return fmt.Errorf("参数 %s 缺少可选值", p.Name)
+			}
+		default:
+			return fmt.Errorf("参数 %s 的类型 %s 未知", p.Name, p.Type)
+		}
+		if p.Default != "" {
+			if _, err := p.check(p.Default); err != nil {
+				return fmt.Errorf("参数 %s 的默认值无效: %v", p.Name, err)
+			}
+		}
+	}
+	for _, m := range runbookPlaceholder.FindAllStringSubmatch(v.Script, -1) {
+		if !declared[m[1]] {
+			return fmt.Errorf("脚本中的 %s 没有定义参数", m[0])
+		}
+	}
+	return nil
+}
+
+// 按类型校验参数值，返回规范化后的值
+func (p *RunbookParam) check(value string) (string, error) {
+	if strings.ContainsFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+		return "", errors.New("不能包含换行等控制字符")
+	}
+	switch p.Type {
+	case ParamInt:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return "", errors.New("必须是整数")
+		}
+		return strconv.Itoa(n), nil
+	case ParamChoice:
+		for _, choice := range p.Choices {
+			if value == choice {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("必须是 %s 之一", strings.Join(p.Choices, "、"))
+	case ParamVM:
+		if !vmNamePattern.MatchString(value) {
+			return "", errors.New("不是有效的虚拟机名称")
+		}
+	case ParamInterface:
+		if !interfaceNamePattern.MatchString(value) {
+			return "", errors.New("不是有效的网络接口名称")
+		}
+	}
+	return value, nil
+}
+
+// 按 POSIX shell 规则加单引号，值中的任何字符都不会被 shell 解释
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// 校验参数并渲染命令：脚本中的 {{name}} 替换为加了引号的参数值，
+// 因此占位符应作为独立的 shell 单词使用，不要再放在引号中
+func (v *RunbookVersion) render(values map[string]string) (string, map[string]string, error) {
+	params := make(map[string]string)
+	for i := range v.Params {
+		p := &v.Params[i]
+		value, ok := values[p.Name]
+		if !ok || value == "" {
+			value = p.Default
+		}
+		if value == "" {
+			if p.Required {
+				return "", nil, fmt.Errorf("缺少参数 %s", p.Name)
+			}
+			params[p.Name] = ""
+			continue
+		}
+		value, err := p.check(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("参数 %s %v", p.Name, err)
+		}
+		params[p.Name] = value
+	}
+	for name := range values {
+		if _, ok := params[name]; !ok {
+			return "", nil, fmt.Errorf("未知参数 %s", name)
+		}
+	}
+	command := runbookPlaceholder.ReplaceAllStringFunc(v.Script, func(m string) string {
+		return shellQuote(params[runbookPlaceholder.FindStringSubmatch(m)[1]])
+	})
+	return command, params, nil
+}
+
+// 运行手册存储，保存在 JSON 文件中
+type runbookStore struct {
+	mu       sync.Mutex
+	path     string
+	runbooks []Runbook
+	// 已分配过的最大ID，删除后不回退，定时任务按ID引用运行手册，ID复用会让它们执行新的脚本
+	lastID int
+}
+
+// 全局运行手册存储，在 main 中初始化
+var runbooks *runbookStore
+
+func newRunbookStore(path string) (*runbookStore, error) {
+	s := &runbookStore{path: path, runbooks: []Runbook{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.lastID, err = unmarshalIDFile(data, "runbooks", &s.runbooks, func(rb Runbook) int { return rb.ID }); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	return s, nil
+}
+
+// 保存运行手册到文件，调用方需持有锁
+func (s *runbookStore) save() error {
+	data, err := marshalIDFile("runbooks", s.lastID, s.runbooks)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// 返回副本，调用方修改不影响存储
+func (s *runbookStore) List() []Runbook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Runbook, len(s.runbooks))
+	for i, rb := range s.runbooks {
+		rb.Versions = append([]RunbookVersion{}, rb.Versions...)
+		list[i] = rb
+	}
+	return list
+}
+
+func (s *runbookStore) Get(id int) (Runbook, error) {
+	for _, rb := range s.List() {
+		if rb.ID == id {
+			return rb, nil
+		}
+	}
+	return Runbook{}, errRunbookNotFound
+}
+
+func (s *runbookStore) Create(name string, ownerID int, v RunbookVersion) (Runbook, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Runbook{}, errors.New("缺少名称")
+	}
+	if err := validateRunbookVersion(&v); err != nil {
+		return Runbook{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.runbooks {
+		if existing.Name == name {
+			return Runbook{}, fmt.Errorf("运行手册 %s 已存在", name)
+		}
+	}
+	s.lastID++
+	v.Version = 1
+	v.CreatedAt = time.Now()
+	rb := Runbook{
+		ID:          s.lastID,
+		Name:        name,
+		CreatedBy:   v.CreatedBy,
+		CreatedByID: ownerID,
+		CreatedAt:   v.CreatedAt,
+		Versions:    []RunbookVersion{v},
+	}
+	s.runbooks = append(s.runbooks, rb)
+	if err := s.save(); err != nil {
+		s.runbooks = s.runbooks[:len(s.runbooks)-1]
+		s.lastID--
+		return Runbook{}, err
+	}
+	return rb, nil
+}
+
+// 保存为新版本，已有版本保持不变
+func (s *runbookStore) AddVersion(id int, v RunbookVersion) (Runbook, error) {
+	if err := validateRunbookVersion(&v); err != nil {
+		return Runbook{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.runbooks {
+		rb := &s.runbooks[i]
+		if rb.ID != id {
+			continue
+		}
+		v.Version = rb.latest().Version + 1
+		v.CreatedAt = time.Now()
+		rb.Versions = append(rb.Versions, v)
+		if err := s.save(); err != nil {
+			rb.Versions = rb.Versions[:len(rb.Versions)-1]
+			return Runbook{}, err
+		}
+		return *rb, nil
+	}
+	return Runbook{}, errRunbookNotFound
+}
+
+func (s *runbookStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, rb := range s.runbooks {
+		if rb.ID != id {
+			continue
+		}
+		old := s.runbooks
+		s.runbooks = append(append([]Runbook{}, old[:i]...), old[i+1:]...)
+		if err := s.save(); err != nil {
+			s.runbooks = old
+			return err
+		}
+		return nil
+	}
+	return errRunbookNotFound
+}
+
+// 运行手册接口
+type runbookRequest struct {
+	Name string `json:"name"`
+	RunbookVersion
+}
+
+func runbookForRequest(c *gin.Context) (Runbook, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errRunbookNotFound.Error()})
+		return Runbook{}, false
+	}
+	rb, err := runbooks.Get(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return Runbook{}, false
+	}
+	return rb, true
+}
+
+// 列表只包含每个运行手册的最新版本
+func listRunbooks(c *gin.Context) {
+	list := runbooks.List()
+	for i := range list {
+		list[i].Versions = list[i].Versions[len(list[i].Versions)-1:]
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getRunbook(c *gin.Context) {
+	if rb, ok := runbookForRequest(c); ok {
+		c.JSON(http.StatusOK, rb)
+	}
+}
+
+func createRunbook(c *gin.Context) {
+	var req runbookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	req.CreatedBy = user.Username
+	rb, err := runbooks.Create(req.Name, user.ID, req.RunbookVersion)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditRunbookCreate, 0, "", AuditSuccess, fmt.Sprintf("运行手册 %d %s", rb.ID, rb.Name))
+	c.JSON(http.StatusCreated, rb)
+}
+
+// 新版本会被使用最新版本的执行和定时任务采用，只有创建者和管理员可以发布
+func (rb *Runbook) editableBy(u *User) bool {
+	if roleAtLeast(u.Role, RoleAdmin) {
+		return true
+	}
+	// 早期创建的运行手册没有记录创建者ID，按用户名判断
+	if rb.CreatedByID == 0 {
+		return rb.CreatedBy == u.Username
+	}
+	return rb.CreatedByID == u.ID
+}
+
+func updateRunbook(c *gin.Context) {
+	rb, ok := runbookForRequest(c)
+	if !ok {
+		return
+	}
+	if !rb.editableBy(currentUser(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有运行手册的创建者和管理员可以修改"})
+		return
+	}
+	var req RunbookVersion
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CreatedBy = currentUser(c).Username
+	rb, err := runbooks.AddVersion(rb.ID, req)
+	if err == errRunbookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditRunbookUpdate, 0, "", AuditSuccess, fmt.Sprintf("运行手册 %d %s v%d", rb.ID, rb.Name, rb.latest().Version))
+	c.JSON(http.StatusOK, rb)
+}
+
+func deleteRunbook(c *gin.Context) {
+	rb, ok := runbookForRequest(c)
+	if !ok {
+		return
+	}
+	// 被定时任务引用的运行手册不能删除，需要先删除或修改这些定时任务
+	if names := schedules.usingRunbook(rb.ID); len(names) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "运行手册被定时任务引用: " + strings.Join(names, ", ")})
+		return
+	}
+	if err := runbooks.Delete(rb.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditRunbookDelete, 0, "", AuditSuccess, fmt.Sprintf("运行手册 %d %s", rb.ID, rb.Name))
+	c.JSON(http.StatusOK, gin.H{"message": "运行手册已删除"})
+}
+
+// 执行运行手册的请求，设备的选择方式与批量任务相同
+type runRunbookRequest struct {
+	Version     int               `json:"version"`
+	Params      map[string]string `json:"params"`
+	Confirm     bool              `json:"confirm"`
+	DeviceIDs   []int             `json:"device_ids"`
+	Tags        []string          `json:"tags"`
+	Concurrency int               `json:"concurrency"`
+	Timeout     int               `json:"timeout"`
+}
+
+// 渲染完成、等待执行的运行手册
+type runbookRun struct {
+	runbook Runbook
+	version *RunbookVersion
+	req     runRunbookRequest
+	command string
+	params  map[string]string
+}
+
+// 校验参数并渲染出要执行的命令
+func renderRunbookRequest(c *gin.Context) (*runbookRun, bool) {
+	rb, ok := runbookForRequest(c)
+	if !ok {
+		return nil, false
+	}
+	run := &runbookRun{runbook: rb}
+	if err := c.ShouldBindJSON(&run.req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if run.version, ok = rb.version(run.req.Version); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("版本 %d 不存在", run.req.Version)})
+		return nil, false
+	}
+	var err error
+	if run.command, run.params, err = run.version.render(run.req.Params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return run, true
+}
+
+// 预览渲染后的命令，不执行
+func renderRunbook(c *gin.Context) {
+	run, ok := renderRunbookRequest(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"version": run.version.Version, "command": run.command, "destructive": run.version.Destructive})
+}
+
+// 以批量任务的方式在选中的设备上执行，结果保存在任务中；
+// 标记为破坏性的运行手册需要在请求中确认
+func runRunbook(c *gin.Context) {
+	run, ok := renderRunbookRequest(c)
+	if !ok {
+		return
+	}
+	if run.version.Destructive && !run.req.Confirm {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            "该运行手册会修改设备状态，请确认后执行",
+			"confirm_required": true,
+			"command":          run.command,
+		})
+		return
+	}
+	job, ok := startJob(c, createJobRequest{
+		Command:     run.command,
+		DeviceIDs:   run.req.DeviceIDs,
+		Tags:        run.req.Tags,
+		Concurrency: run.req.Concurrency,
+		Timeout:     run.req.Timeout,
+	}, &JobRunbook{ID: run.runbook.ID, Name: run.runbook.Name, Version: run.version.Version, Params: run.params})
+	if ok {
+		c.JSON(http.StatusCreated, job)
+	}
+}
+
+// 运行手册的执行记录，只包含当前用户可以查看的任务
+func listRunbookRuns(c *gin.Context) {
+	rb, ok := runbookForRequest(c)
+	if !ok {
+		return
+	}
+	list := jobs.list()
+	user := currentUser(c)
+	result := []*Job{}
+	for _, job := range list {
+		if len(result) >= jobListLimit {
+			break
+		}
+		if job.Runbook == nil || job.Runbook.ID != rb.ID || job.Runbook.Name != rb.Name {
+			continue
+		}
+		if job.CreatedByID == user.ID || roleAtLeast(user.Role, RoleAdmin) {
+			result = append(result, job)
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+// 定时任务类型
+const (
+	ScheduleCommand   = "command"    // 执行命令
+	ScheduleRunbook   = "runbook"    // 执行运行手册
+	ScheduleVMRefresh = "vm_refresh" // 刷新虚拟机信息
+)
+
+// 上一次执行尚未结束时的处理方式
+const (
+	OverlapSkip  = "skip"  // 跳过本次
+	OverlapQueue = "queue" // 上一次结束后立即执行，最多排队一次
+)
+
+// 定时任务单次执行的结果
+const (
+	ScheduleRunSuccess = "success"
+	ScheduleRunFailed  = "failed" // 有设备执行失败或任务无法开始
+	ScheduleRunSkipped = "skipped"
+)
+
+const (
+	scheduleHistoryLimit  = 50 // 每个定时任务保留的执行记录数
+	scheduleNotifyTimeout = 10 * time.Second
+)
+
+// 定时任务，以创建者的身份和权限执行
+type Schedule struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`               // 标准 5 段 cron 表达式，或 @daily、@every 1h 等
+	Timezone string `json:"timezone,omitempty"` // IANA 时区，如 Asia/Shanghai，默认服务器本地时区
+	Enabled  bool   `json:"enabled"`
+	Kind     string `json:"kind"`
+	Overlap  string `json:"overlap"`
+
+	Command        string            `json:"command,omitempty"`
+	RunbookID      int               `json:"runbook_id,omitempty"`
+	RunbookVersion int               `json:"runbook_version,omitempty"` // 0 表示执行时的最新版本
+	Params         map[string]string `json:"params,omitempty"`
+	// 保存时确认过的需要确认的运行手册版本，只由服务端设置
+	ConfirmedVersion int `json:"confirmed_version,omitempty"`
+
+	DeviceIDs   []int    `json:"device_ids,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	Timeout     int      `json:"timeout,omitempty"`
+
+	OwnerID   int            `json:"owner_id"`
+	Owner     string         `json:"owner"`
+	Scope     *ScheduleScope `json:"scope,omitempty"` // 通过 API 令牌保存时记录令牌的范围
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	History   []ScheduleRun  `json:"history,omitempty"` // 最新的在后
+}
+
+// 保存定时任务的 API 令牌的角色和设备范围，执行时同样收窄所有者的权限
+type ScheduleScope struct {
+	Role      string `json:"role,omitempty"`
+	DeviceIDs []int  `json:"device_ids,omitempty"`
+}
+
+// 记录令牌请求的范围，浏览器会话保存时返回 nil
+func scheduleScopeOf(u *User) *ScheduleScope {
+	if !u.viaToken {
+		return nil
+	}
+	return &ScheduleScope{Role: u.Role, DeviceIDs: u.scopeDevices}
+}
+
+// 与令牌认证相同：角色不超过所有者当前角色，限定设备范围
+func (s *ScheduleScope) apply(u *User) {
+	if s == nil {
+		return
+	}
+	if s.Role != "" && roleAtLeast(u.Role, s.Role) {
+		u.Role = s.Role
+	}
+	u.scopeDevices = s.DeviceIDs
+}
+
+// 定时任务的一次执行
+type ScheduleRun struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Manual     bool       `json:"manual,omitempty"` // 通过接口立即执行
+	Status     string     `json:"status"`
+	JobID      string     `json:"job_id,omitempty"` // 命令和运行手册的输出保存在批量任务中
+	Total      int        `json:"total"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"`
+	Hosts      []*JobHost `json:"hosts,omitempty"` // 刷新虚拟机信息时每台设备的结果
+}
+
+var errScheduleNotFound = errors.New("定时任务不存在")
+
+// 带时区的 cron 表达式
+func (sc *Schedule) spec() string {
+	if sc.Timezone == "" {
+		return sc.Cron
+	}
+	return "CRON_TZ=" + sc.Timezone + " " + sc.Cron
+}
+
+func validateSchedule(sc *Schedule) error {
+	sc.Name = strings.TrimSpace(sc.Name)
+	if sc.Name == "" {
+		return errors.New("缺少名称")
+	}
+	if strings.Contains(sc.Cron, "TZ=") {
+		return errors.New("时区请通过 timezone 指定")
+	}
+	if sc.Timezone != "" {
+		if _, err := time.LoadLocation(sc.Timezone); err != nil {
+			return fmt.Errorf("未知时区: %s", sc.Timezone)
+		}
+	}
+	if _, err := cron.ParseStandard(sc.spec()); err != nil {
+		return fmt.Errorf("cron 表达式错误: %v", err)
+	}
+	if sc.Overlap == "" {
+		sc.Overlap = OverlapSkip
+	}
+	if sc.Overlap != OverlapSkip && sc.Overlap != OverlapQueue {
+		return fmt.Errorf("未知的重叠策略: %s", sc.Overlap)
+	}
+	if len(sc.DeviceIDs) == 0 && len(sc.Tags) == 0 {
+		return errors.New("没有选择设备")
+	}
+	if sc.Concurrency < 0 || sc.Concurrency > jobMaxConcurrency || sc.Timeout < 0 || sc.Timeout > jobMaxTimeout {
+		return fmt.Errorf("并发数不能超过 %d，超时不能超过 %d 秒", jobMaxConcurrency, jobMaxTimeout)
+	}
+	switch sc.Kind {
+	case ScheduleCommand:
+		sc.Command = strings.TrimSpace(sc.Command)
+		if sc.Command == "" {
+			return errors.New("缺少命令")
+		}
+	case ScheduleRunbook:
+		if _, _, err := sc.renderRunbook(); err != nil {
+			return err
+		}
+	case ScheduleVMRefresh:
+	default:
+		return fmt.Errorf("未知的定时任务类型: %s", sc.Kind)
+	}
+	return nil
+}
+
+// 按当前的运行手册渲染命令
+func (sc *Schedule) renderRunbook() (string, *JobRunbook, error) {
+	rb, err := runbooks.Get(sc.RunbookID)
+	if err != nil {
+		return "", nil, err
+	}
+	v, ok := rb.version(sc.RunbookVersion)
+	if !ok {
+		return "", nil, fmt.Errorf("运行手册 %s 没有版本 %d", rb.Name, sc.RunbookVersion)
+	}
+	// 执行最新版本时，之后保存的版本如果需要确认，要重新确认并保存定时任务后才会执行
+	if v.Destructive && v.Version != sc.ConfirmedVersion {
+		return "", nil, fmt.Errorf("运行手册 %s 版本 %d 会修改设备状态，请确认后重新保存定时任务", rb.Name, v.Version)
+	}
+	command, params, err := v.render(sc.Params)
+	if err != nil {
+		return "", nil, err
+	}
+	return command, &JobRunbook{ID: rb.ID, Name: rb.Name, Version: v.Version, Params: params}, nil
+}
+
+// 定时任务存储和调度，定时任务保存在 JSON 文件中
+type scheduler struct {
+	mu        sync.Mutex
+	path      string
+	schedules []Schedule
+	lastID    int // 已分配过的最大ID，删除后不回退
+	cron      *cron.Cron
+	entries   map[int]cron.EntryID
+	running   map[int]bool
+	queued    map[int]bool
+	webhook   string // 执行失败时通知的地址
+}
+
+// 全局定时任务，在 main 中初始化
+var schedules *scheduler
+
+func newScheduler(path, webhook string) (*scheduler, error) {
+	s := &scheduler{
+		path:      path,
+		schedules: []Schedule{},
+		cron:      cron.New(),
+		entries:   make(map[int]cron.EntryID),
+		running:   make(map[int]bool),
+		queued:    make(map[int]bool),
+		webhook:   webhook,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if s.lastID, err = unmarshalIDFile(data, "schedules", &s.schedules, func(sc Schedule) int { return sc.ID }); err != nil {
+			return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+		}
+	}
+	for i := range s.schedules {
+		if err := s.registerLocked(&s.schedules[i]); err != nil {
+			return nil, fmt.Errorf("定时任务 %s: %v", s.schedules[i].Name, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *scheduler) Start() { s.cron.Start() }
+
+// 停止调度，不等待执行中的任务
+func (s *scheduler) Stop() { s.cron.Stop() }
+
+// 保存定时任务到文件，调用方需持有锁
+func (s *scheduler) save() error {
+	data, err := marshalIDFile("schedules", s.lastID, s.schedules)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// 按定时任务的当前配置更新调度，调用方需持有锁
+func (s *scheduler) registerLocked(sc *Schedule) error {
+	if id, ok := s.entries[sc.ID]; ok {
+		s.cron.Remove(id)
+		delete(s.entries, sc.ID)
+	}
+	if !sc.Enabled {
+		return nil
+	}
+	scheduleID := sc.ID
+	entry, err := s.cron.AddFunc(sc.spec(), func() { s.trigger(scheduleID, false) })
+	if err != nil {
+		return err
+	}
+	s.entries[sc.ID] = entry
+	return nil
+}
+
+func (s *scheduler) indexLocked(id int) int {
+	for i := range s.schedules {
+		if s.schedules[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 返回副本，不含执行记录
+func (s *scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Schedule, len(s.schedules))
+	for i, sc := range s.schedules {
+		sc.History = nil
+		list[i] = sc
+	}
+	return list
+}
+
+// 引用运行手册的定时任务名称
+func (s *scheduler) usingRunbook(id int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, sc := range s.schedules {
+		if sc.Kind == ScheduleRunbook && sc.RunbookID == id {
+			names = append(names, sc.Name)
+		}
+	}
+	return names
+}
+
+func (s *scheduler) Get(id int) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return Schedule{}, errScheduleNotFound
+	}
+	sc := s.schedules[i]
+	sc.History = append([]ScheduleRun{}, sc.History...)
+	return sc, nil
+}
+
+// 执行状态：下次执行时间、是否正在执行和最近一次执行
+func (s *scheduler) status(id int) (*time.Time, bool, *ScheduleRun) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	running := s.running[id]
+	var last *ScheduleRun
+	if i := s.indexLocked(id); i >= 0 && len(s.schedules[i].History) > 0 {
+		run := s.schedules[i].History[len(s.schedules[i].History)-1]
+		last = &run
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, running, last
+	}
+	next := s.cron.Entry(entry).Next
+	if next.IsZero() {
+		return nil, running, last
+	}
+	return &next, running, last
+}
+
+func (s *scheduler) Create(sc Schedule) (Schedule, error) {
+	if err := validateSchedule(&sc); err != nil {
+		return Schedule{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	sc.ID = s.lastID
+	sc.CreatedAt = time.Now()
+	sc.UpdatedAt = sc.CreatedAt
+	sc.History = nil
+
+	s.schedules = append(s.schedules, sc)
+	if err := s.save(); err != nil {
+		s.schedules = s.schedules[:len(s.schedules)-1]
+		s.lastID--
+		return Schedule{}, err
+	}
+	if err := s.registerLocked(&sc); err != nil {
+		log.Printf("注册定时任务 %s 失败: %v", sc.Name, err)
+	}
+	return sc, nil
+}
+
+// 修改定时任务，fn 修改后重新校验和调度
+func (s *scheduler) Update(id int, fn func(sc *Schedule) error) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return Schedule{}, errScheduleNotFound
+	}
+	sc := s.schedules[i]
+	if err := fn(&sc); err != nil {
+		return Schedule{}, err
+	}
+	if err := validateSchedule(&sc); err != nil {
+		return Schedule{}, err
+	}
+	sc.UpdatedAt = time.Now()
+	old := s.schedules[i]
+	s.schedules[i] = sc
+	if err := s.save(); err != nil {
+		s.schedules[i] = old
+		return Schedule{}, err
+	}
+	if err := s.registerLocked(&sc); err != nil {
+		log.Printf("注册定时任务 %s 失败: %v", sc.Name, err)
+	}
+	sc.History = nil
+	return sc, nil
+}
+
+// 启用或停用；停用时不校验配置，引用的运行手册被删除后也可以停用
+func (s *scheduler) SetEnabled(id int, enabled bool) (Schedule, error) {
+	if enabled {
+		return s.Update(id, func(sc *Schedule) error {
+			sc.Enabled = true
+			return nil
+		})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return Schedule{}, errScheduleNotFound
+	}
+	old := s.schedules[i]
+	sc := &s.schedules[i]
+	sc.Enabled, sc.UpdatedAt = false, time.Now()
+	if err := s.save(); err != nil {
+		s.schedules[i] = old
+		return Schedule{}, err
+	}
+	s.registerLocked(sc)
+	result := *sc
+	result.History = nil
+	return result, nil
+}
+
+func (s *scheduler) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return errScheduleNotFound
+	}
+	old := s.schedules
+	s.schedules = append(append([]Schedule{}, old[:i]...), old[i+1:]...)
+	if err := s.save(); err != nil {
+		s.schedules = old
+		return err
+	}
+	disabled := Schedule{ID: id}
+	s.registerLocked(&disabled)
+	delete(s.queued, id)
+	return nil
+}
+
+// 删除满足条件的定时任务并取消调度，返回删除的条数
+func (s *scheduler) DeleteWhere(match func(sc Schedule) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []Schedule{}
+	var removed []int
+	for _, sc := range s.schedules {
+		if match(sc) {
+			removed = append(removed, sc.ID)
+		} else {
+			kept = append(kept, sc)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	old := s.schedules
+	s.schedules = kept
+	if err := s.save(); err != nil {
+		s.schedules = old
+		return 0, err
+	}
+	for _, id := range removed {
+		disabled := Schedule{ID: id}
+		s.registerLocked(&disabled)
+		delete(s.queued, id)
+	}
+	return len(removed), nil
+}
+
+// 保存一次执行的结果，只保留最近的记录
+func (s *scheduler) record(id int, run ScheduleRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return
+	}
+	sc := &s.schedules[i]
+	sc.History = append(sc.History, run)
+	if n := len(sc.History) - scheduleHistoryLimit; n > 0 {
+		sc.History = append([]ScheduleRun{}, sc.History[n:]...)
+	}
+	if err := s.save(); err != nil {
+		log.Printf("保存定时任务 %s 的执行记录失败: %v", sc.Name, err)
+	}
+}
+
+// 到点或手动触发；上一次执行尚未结束时按重叠策略跳过或排队
+func (s *scheduler) trigger(id int, manual bool) {
+	s.mu.Lock()
+	i := s.indexLocked(id)
+	if i < 0 || (!manual && !s.schedules[i].Enabled) {
+		s.mu.Unlock()
+		return
+	}
+	sc := s.schedules[i]
+	if s.running[id] {
+		if sc.Overlap == OverlapQueue && !s.queued[id] {
+			s.queued[id] = true
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		now := time.Now()
+		s.record(id, ScheduleRun{StartedAt: now, FinishedAt: &now, Manual: manual, Status: ScheduleRunSkipped, Error: "上一次执行尚未结束"})
+		return
+	}
+	s.running[id] = true
+	s.mu.Unlock()
+
+	for {
+		run := s.execute(&sc)
+		run.Manual = manual
+		s.record(id, run)
+		if run.Status == ScheduleRunFailed {
+			s.notify(&sc, run)
+		}
+
+		s.mu.Lock()
+		i := s.indexLocked(id)
+		if !s.queued[id] || i < 0 {
+			delete(s.running, id)
+			delete(s.queued, id)
+			s.mu.Unlock()
+			return
+		}
+		delete(s.queued, id)
+		sc, manual = s.schedules[i], false
+		s.mu.Unlock()
+	}
+}
+
+// 以所有者的身份执行一次，返回执行结果
+func (s *scheduler) execute(sc *Schedule) (run ScheduleRun) {
+	run = ScheduleRun{StartedAt: time.Now(), Status: ScheduleRunFailed}
+	defer func() {
+		now := time.Now()
+		run.FinishedAt = &now
+	}()
+	owner, err := users.Get(sc.OwnerID)
+	if err != nil || owner.Disabled {
+		run.Error = "所有者账号不存在或已停用"
+		return run
+	}
+	sc.Scope.apply(&owner)
+	if sc.Kind == ScheduleVMRefresh {
+		s.refreshVMs(sc, &owner, &run)
+		return run
+	}
+
+	command, runbook := sc.Command, (*JobRunbook)(nil)
+	if sc.Kind == ScheduleRunbook {
+		if command, runbook, err = sc.renderRunbook(); err != nil {
+			run.Error = err.Error()
+			return run
+		}
+	}
+	job, devices, denied, err := prepareJob(&owner, createJobRequest{
+		Command:     command,
+		DeviceIDs:   sc.DeviceIDs,
+		Tags:        sc.Tags,
+		Concurrency: sc.Concurrency,
+		Timeout:     sc.Timeout,
+	}, runbook)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	job.ScheduleID = sc.ID
+	r, err := jobs.Start(job, devices, "")
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	for _, id := range denied {
+		r.audit(AuditAccessDenied, id, AuditDenied, ActionWebShell+" 任务 "+job.ID)
+	}
+	r.audit(AuditJobRun, 0, AuditSuccess, fmt.Sprintf("定时任务 %d %s ", sc.ID, sc.Name)+job.auditDetail(len(devices)))
+	run.JobID = job.ID
+
+	final := r.wait()
+	run.Total = len(final.Hosts)
+	for _, host := range final.Hosts {
+		if host.Status != JobHostSuccess {
+			run.Failed++
+		}
+	}
+	if run.Failed == 0 {
+		run.Status = ScheduleRunSuccess
+	}
+	return run
+}
+
+// 刷新选中设备的虚拟机信息，需要设备的 flush 权限
+func (s *scheduler) refreshVMs(sc *Schedule, owner *User, run *ScheduleRun) {
+	selected, err := selectJobDevices(createJobRequest{DeviceIDs: sc.DeviceIDs, Tags: sc.Tags})
+	if err != nil {
+		run.Error = err.Error()
+		return
+	}
+	concurrency := sc.Concurrency
+	if concurrency <= 0 {
+		concurrency = jobDefaultConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range selected {
+		dev := &selected[i]
+		host := &JobHost{DeviceID: dev.ID, Name: dev.Name, Status: JobHostSuccess}
+		run.Hosts = append(run.Hosts, host)
+		switch {
+		case !deviceAllowed(owner, dev, ActionFlush):
+			host.Status, host.Error = JobHostDenied, "没有该设备的操作权限"
+			s.audit(sc, AuditAccessDenied, dev.ID, AuditDenied, ActionFlush)
+			continue
+		case !deviceHasSSHCredentials(dev):
+			host.Status, host.Error = JobHostFailed, "设备SSH配置不完整"
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			started := time.Now()
+			host.StartedAt = &started
+			vms, err := refreshDeviceVMs(dev)
+			finished := time.Now()
+			host.FinishedAt = &finished
+			outcome := AuditSuccess
+			if err != nil {
+				host.Status, host.Error, outcome = JobHostFailed, err.Error(), AuditFailure
+			} else {
+				host.Output = fmt.Sprintf("%d 台虚拟机", len(vms))
+			}
+			s.audit(sc, AuditVMRefresh, dev.ID, outcome, host.Error)
+		}()
+	}
+	wg.Wait()
+	run.Total = len(run.Hosts)
+	for _, host := range run.Hosts {
+		if host.Status != JobHostSuccess {
+			run.Failed++
+		}
+	}
+	if run.Total == 0 {
+		run.Error = "没有选中任何设备"
+	} else if run.Failed == 0 {
+		run.Status = ScheduleRunSuccess
+	}
+}
+
+// 定时任务在后台执行，以所有者的名义记入审计
+func (s *scheduler) audit(sc *Schedule, action string, deviceID int, outcome, detail string) {
+	if audit == nil {
+		return
+	}
+	if detail != "" {
+		detail = " " + detail
+	}
+	err := audit.Append(AuditEntry{
+		Actor:    sc.Owner,
+		ActorID:  sc.OwnerID,
+		Action:   action,
+		DeviceID: deviceID,
+		Outcome:  outcome,
+		Detail:   fmt.Sprintf("定时任务 %d %s", sc.ID, sc.Name) + detail,
+	})
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// 执行失败时以 JSON 形式 POST 到通知地址
+func (s *scheduler) notify(sc *Schedule, run ScheduleRun) {
+	log.Printf("定时任务 %s 执行失败: 失败 %d/%d %s", sc.Name, run.Failed, run.Total, run.Error)
+	if s.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(gin.H{
+		"schedule": gin.H{"id": sc.ID, "name": sc.Name, "kind": sc.Kind, "owner": sc.Owner},
+		"run":      run,
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: scheduleNotifyTimeout}
+	resp, err := client.Post(s.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("发送定时任务失败通知失败: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("发送定时任务失败通知失败: %s", resp.Status)
+	}
+}
+
+// 定时任务接口
+type scheduleResponse struct {
+	Schedule
+	NextRun *time.Time   `json:"next_run,omitempty"`
+	Running bool         `json:"running"`
+	LastRun *ScheduleRun `json:"last_run,omitempty"`
+}
+
+func newScheduleResponse(sc Schedule) scheduleResponse {
+	next, running, last := schedules.status(sc.ID)
+	return scheduleResponse{Schedule: sc, NextRun: next, Running: running, LastRun: last}
+}
+
+// 只有所有者和管理员可以查看和管理定时任务
+func scheduleForRequest(c *gin.Context) (Schedule, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errScheduleNotFound.Error()})
+		return Schedule{}, false
+	}
+	sc, err := schedules.Get(id)
+	user := currentUser(c)
+	if err != nil || (sc.OwnerID != user.ID && !roleAtLeast(user.Role, RoleAdmin)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errScheduleNotFound.Error()})
+		return Schedule{}, false
+	}
+	return sc, true
+}
+
+func listSchedules(c *gin.Context) {
+	user := currentUser(c)
+	result := []scheduleResponse{}
+	for _, sc := range schedules.List() {
+		if sc.OwnerID == user.ID || roleAtLeast(user.Role, RoleAdmin) {
+			result = append(result, newScheduleResponse(sc))
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func getSchedule(c *gin.Context) {
+	if sc, ok := scheduleForRequest(c); ok {
+		c.JSON(http.StatusOK, newScheduleResponse(sc))
+	}
+}
+
+// 创建和修改定时任务的请求，destructive 的运行手册需要确认
+type scheduleRequest struct {
+	Schedule
+	Confirm bool `json:"confirm"`
+}
+
+// 定时执行需要确认的运行手册时，创建或修改定时任务即视为确认，并记录确认的是哪个版本
+func (req *scheduleRequest) checkConfirm() error {
+	req.ConfirmedVersion = 0
+	if req.Kind != ScheduleRunbook {
+		return nil
+	}
+	rb, err := runbooks.Get(req.RunbookID)
+	if err != nil {
+		return err
+	}
+	v, ok := rb.version(req.RunbookVersion)
+	if !ok || !v.Destructive {
+		return nil
+	}
+	if !req.Confirm {
+		return errors.New("该运行手册会修改设备状态，请确认后保存定时任务")
+	}
+	req.ConfirmedVersion = v.Version
+	return nil
+}
+
+func createSchedule(c *gin.Context) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.checkConfirm(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	req.OwnerID, req.Owner = user.ID, user.Username
+	req.Scope = scheduleScopeOf(user)
+	sc, err := schedules.Create(req.Schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditScheduleCreate, 0, "", AuditSuccess, fmt.Sprintf("定时任务 %d %s %s %s", sc.ID, sc.Name, sc.Kind, sc.spec()))
+	c.JSON(http.StatusCreated, newScheduleResponse(sc))
+}
+
+// 修改定时任务的配置，所有者和执行记录保持不变；
+// 通过 API 令牌修改时范围改为该令牌的范围，否则保留原来的范围
+func updateSchedule(c *gin.Context) {
+	existing, ok := scheduleForRequest(c)
+	if !ok {
+		return
+	}
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.checkConfirm(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	sc, err := schedules.Update(existing.ID, func(sc *Schedule) error {
+		next := req.Schedule
+		next.ID, next.OwnerID, next.Owner, next.Scope = sc.ID, sc.OwnerID, sc.Owner, sc.Scope
+		if scope := scheduleScopeOf(user); scope != nil {
+			next.Scope = scope
+		}
+		next.CreatedAt, next.History = sc.CreatedAt, sc.History
+		*sc = next
+		return nil
+	})
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditScheduleUpdate, 0, "", AuditSuccess, fmt.Sprintf("定时任务 %d %s %s %s", sc.ID, sc.Name, sc.Kind, sc.spec()))
+	c.JSON(http.StatusOK, newScheduleResponse(sc))
+}
+
+func setScheduleEnabled(c *gin.Context, enabled bool) {
+	existing, ok := scheduleForRequest(c)
+	if !ok {
+		return
+	}
+	sc, err := schedules.SetEnabled(existing.ID, enabled)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	detail := fmt.Sprintf("定时任务 %d %s 停用", sc.ID, sc.Name)
+	if enabled {
+		detail = fmt.Sprintf("定时任务 %d %s 启用", sc.ID, sc.Name)
+	}
+	recordAudit(c, AuditScheduleUpdate, 0, "", AuditSuccess, detail)
+	c.JSON(http.StatusOK, newScheduleResponse(sc))
+}
+
+func enableSchedule(c *gin.Context)  { setScheduleEnabled(c, true) }
+func disableSchedule(c *gin.Context) { setScheduleEnabled(c, false) }
+
+func deleteSchedule(c *gin.Context) {
+	sc, ok := scheduleForRequest(c)
+	if !ok {
+		return
+	}
+	if err := schedules.Delete(sc.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditScheduleDelete, 0, "", AuditSuccess, fmt.Sprintf("定时任务 %d %s", sc.ID, sc.Name))
+	c.JSON(http.StatusOK, gin.H{"message": "定时任务已删除"})
+}
+
+// 立即执行一次，不影响原有的调度，结果记入执行记录
+func runScheduleNow(c *gin.Context) {
+	sc, ok := scheduleForRequest(c)
+	if !ok {
+		return
+	}
+	go schedules.trigger(sc.ID, true)
+	recordAudit(c, AuditScheduleRun, 0, "", AuditSuccess, fmt.Sprintf("定时任务 %d %s", sc.ID, sc.Name))
+	c.JSON(http.StatusAccepted, gin.H{"message": "已开始执行"})
+}
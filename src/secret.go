@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 加密字段前缀，格式: enc:v1:<主密钥ID>:<被主密钥包裹的数据密钥>:<密文>
+const secretPrefix = "enc:v1:"
+
+// 主密钥所在的环境变量，值为 base64 编码的 32 字节密钥
+const masterKeyEnv = "ICS_MASTER_KEY"
+
+// 信封加密：每个字段使用随机数据密钥加密，数据密钥再由主密钥包裹
+type secretBox struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("主密钥长度必须为32字节，当前为%d字节", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &secretBox{keyID: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 读取主密钥，优先使用密钥文件，其次使用环境变量；都未配置时返回 nil
+func loadMasterKey(path string) ([]byte, error) {
+	var raw string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取主密钥文件失败: %v", err)
+		}
+		// 文件内容为原始32字节时直接使用
+		if len(data) == 32 {
+			return data, nil
+		}
+		raw = string(data)
+	} else {
+		raw = os.Getenv(masterKeyEnv)
+		if raw == "" {
+			return nil, nil
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("主密钥不是合法的base64: %v", err)
+	}
+	return key, nil
+}
+
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+func sealAEAD(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAEAD(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("密文长度错误")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// 加密单个字段，空值和已加密的值原样返回
+func (b *secretBox) encrypt(value string) (string, error) {
+	if value == "" || isEncryptedSecret(value) {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAEAD(dataAEAD, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealAEAD(b.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawStdEncoding
+	return secretPrefix + b.keyID + ":" + enc.EncodeToString(wrappedKey) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// 拆分密文字段
+func parseSecret(value string) (keyID string, wrappedKey, ciphertext []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("密文格式错误")
+	}
+	enc := base64.RawStdEncoding
+	if wrappedKey, err = enc.DecodeString(parts[1]); err != nil {
+		return "", nil, nil, errors.New("密文格式错误")
+	}
+	if ciphertext, err = enc.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, errors.New("密文格式错误")
+	}
+	return parts[0], wrappedKey, ciphertext, nil
+}
+
+func (b *secretBox) unwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	if keyID != b.keyID {
+		return nil, fmt.Errorf("密文由其他主密钥(%s)加密", keyID)
+	}
+	dataKey, err := openAEAD(b.aead, wrappedKey)
+	if err != nil {
+		return nil, errors.New("主密钥错误，无法解开数据密钥")
+	}
+	return dataKey, nil
+}
+
+// 解密单个字段，未加密的值原样返回
+func (b *secretBox) decrypt(value string) (string, error) {
+	if !isEncryptedSecret(value) {
+		return value, nil
+	}
+	keyID, wrappedKey, ciphertext, err := parseSecret(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := b.unwrapKey(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openAEAD(dataAEAD, ciphertext)
+	if err != nil {
+		return "", errors.New("密文校验失败")
+	}
+	return string(plaintext), nil
+}
+
+// 用新主密钥重新包裹数据密钥，密文本身不变；明文字段直接用新主密钥加密
+func (b *secretBox) rewrap(value string, newBox *secretBox) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if !isEncryptedSecret(value) {
+		return newBox.encrypt(value)
+	}
+	keyID, wrappedKey, ciphertext, err := parseSecret(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := b.unwrapKey(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	newWrapped, err := sealAEAD(newBox.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return secretPrefix + newBox.keyID + ":" + enc.EncodeToString(newWrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// 设备中需要加密保存、且不返回给浏览器的字段
+func deviceSecretFields(dev *CSMPDevice) map[string]*string {
+	fields := map[string]*string{
+		"password": &dev.Password,
+		"ssh_pass": &dev.SSHPass,
+		"vnc_pass": &dev.VNCPass,
+
+		"ssh_key":            &dev.SSHKey,
+		"ssh_key_passphrase": &dev.SSHKeyPassphrase,
+	}
+	// 跳板机的凭据按序号命名，例如 jump_hosts.0.password
+	for i := range dev.JumpHosts {
+		prefix := fmt.Sprintf("jump_hosts.%d.", i)
+		for name, field := range jumpHostSecretFields(&dev.JumpHosts[i]) {
+			fields[prefix+name] = field
+		}
+	}
+	return fields
+}
+
+func jumpHostSecretFields(h *JumpHost) map[string]*string {
+	return map[string]*string{
+		"password":       &h.Password,
+		"key":            &h.Key,
+		"key_passphrase": &h.KeyPassphrase,
+	}
+}
+
+// 编辑设备时未填写的敏感字段保留原值。跳板机的序号会因增删、调整顺序而变化，
+// 按 用户@地址 匹配原来的跳板机，匹配不到的跳板机不继承任何凭据
+func preserveDeviceSecrets(old, updated *CSMPDevice) {
+	oldFields := deviceSecretFields(old)
+	for name, field := range deviceSecretFields(updated) {
+		if strings.HasPrefix(name, "jump_hosts.") {
+			continue
+		}
+		if *field == "" {
+			*field = *oldFields[name]
+		}
+	}
+
+	// 同一跳板机在链中出现多次时按出现顺序依次匹配
+	oldHosts := make(map[string][]*JumpHost)
+	for i := range old.JumpHosts {
+		h := &old.JumpHosts[i]
+		key := h.User + "@" + h.address()
+		oldHosts[key] = append(oldHosts[key], h)
+	}
+	for i := range updated.JumpHosts {
+		h := &updated.JumpHosts[i]
+		key := h.User + "@" + h.address()
+		if len(oldHosts[key]) == 0 {
+			continue
+		}
+		prev := oldHosts[key][0]
+		oldHosts[key] = oldHosts[key][1:]
+		prevFields := jumpHostSecretFields(prev)
+		for name, field := range jumpHostSecretFields(h) {
+			if *field == "" {
+				*field = *prevFields[name]
+			}
+		}
+	}
+}
+
+// 对设备的所有敏感字段执行 fn
+func transformDeviceSecrets(dev *CSMPDevice, fn func(string) (string, error)) error {
+	for name, field := range deviceSecretFields(dev) {
+		value, err := fn(*field)
+		if err != nil {
+			return fmt.Errorf("设备 %d 字段 %s: %v", dev.ID, name, err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// 返回给浏览器的设备信息，敏感字段只写不读，只标明是否已设置
+type deviceResponse struct {
+	CSMPDevice
+	SecretsSet  []string `json:"secrets_set"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+func redactDevice(dev CSMPDevice) deviceResponse {
+	resp := deviceResponse{SecretsSet: []string{}}
+	for name, field := range deviceSecretFields(&dev) {
+		if *field != "" {
+			resp.SecretsSet = append(resp.SecretsSet, name)
+		}
+		*field = ""
+	}
+	sort.Strings(resp.SecretsSet)
+	resp.CSMPDevice = dev
+	return resp
+}
+
+// 加密存储装饰器：写入前加密敏感字段，读取后解密
+type secretDeviceStore struct {
+	inner DeviceStore
+	box   *secretBox
+}
+
+// 包装设备存储，并把历史遗留的明文字段加密保存
+func newSecretDeviceStore(inner DeviceStore, box *secretBox) (*secretDeviceStore, error) {
+	s := &secretDeviceStore{inner: inner, box: box}
+	devices, err := inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devices {
+		plain := false
+		for _, field := range deviceSecretFields(&dev) {
+			if *field != "" && !isEncryptedSecret(*field) {
+				plain = true
+			}
+		}
+		if !plain {
+			continue
+		}
+		_, err := inner.Update(dev.ID, func(d *CSMPDevice) error {
+			return transformDeviceSecrets(d, box.encrypt)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("加密设备 %d 失败: %v", dev.ID, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *secretDeviceStore) Get(id int) (CSMPDevice, error) {
+	dev, err := s.inner.Get(id)
+	if err != nil {
+		return CSMPDevice{}, err
+	}
+	if err := transformDeviceSecrets(&dev, s.box.decrypt); err != nil {
+		return CSMPDevice{}, err
+	}
+	return dev, nil
+}
+
+func (s *secretDeviceStore) List() ([]CSMPDevice, error) {
+	devices, err := s.inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if err := transformDeviceSecrets(&devices[i], s.box.decrypt); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+func (s *secretDeviceStore) Create(dev CSMPDevice) (CSMPDevice, error) {
+	plain := dev
+	if err := transformDeviceSecrets(&dev, s.box.encrypt); err != nil {
+		return CSMPDevice{}, err
+	}
+	created, err := s.inner.Create(dev)
+	if err != nil {
+		return CSMPDevice{}, err
+	}
+	plain.ID = created.ID
+	return plain, nil
+}
+
+func (s *secretDeviceStore) Update(id int, fn func(dev *CSMPDevice) error) (CSMPDevice, error) {
+	var plain CSMPDevice
+	_, err := s.inner.Update(id, func(dev *CSMPDevice) error {
+		if err := transformDeviceSecrets(dev, s.box.decrypt); err != nil {
+			return err
+		}
+		if err := fn(dev); err != nil {
+			return err
+		}
+		plain = cloneDevice(*dev)
+		return transformDeviceSecrets(dev, s.box.encrypt)
+	})
+	if err != nil {
+		return CSMPDevice{}, err
+	}
+	plain.ID = id
+	return plain, nil
+}
+
+func (s *secretDeviceStore) Delete(id int) error {
+	return s.inner.Delete(id)
+}
+
+// 转发底层存储的事件，并解密其中的设备信息
+func (s *secretDeviceStore) Watch() (<-chan DeviceEvent, func()) {
+	events, cancel := s.inner.Watch()
+	out := make(chan DeviceEvent, 16)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			if err := transformDeviceSecrets(&ev.Device, s.box.decrypt); err != nil {
+				continue
+			}
+			// 订阅者处理不过来时丢弃事件
+			select {
+			case out <- ev:
+			default:
+			}
+		}
+	}()
+	return out, cancel
+}
+
+func (s *secretDeviceStore) Close() error {
+	return s.inner.Close()
+}
+
+// 密钥轮换：用新主密钥重新包裹所有设备的数据密钥
+func rotateMasterKey(store DeviceStore, oldBox, newBox *secretBox) (int, error) {
+	rewrap := func(value string) (string, error) {
+		if oldBox == nil {
+			if isEncryptedSecret(value) {
+				return "", errors.New("字段已加密，需要提供当前主密钥")
+			}
+			return newBox.encrypt(value)
+		}
+		return oldBox.rewrap(value, newBox)
+	}
+
+	devices, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	// 先完整试算一遍，避免中途失败导致部分设备已换成新密钥
+	for _, dev := range devices {
+		if err := transformDeviceSecrets(&dev, rewrap); err != nil {
+			return 0, err
+		}
+	}
+	for _, dev := range devices {
+		_, err := store.Update(dev.ID, func(d *CSMPDevice) error {
+			return transformDeviceSecrets(d, rewrap)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(devices), nil
+}
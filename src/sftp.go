@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// 在设备的池化 SSH 连接上打开 SFTP 子系统，凭据与 WebShell 相同
+func openDeviceSFTP(dev *CSMPDevice) (*sftp.Client, func(), error) {
+	session, release, err := sshClients.Session(dev)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SSH连接失败: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("设备不支持SFTP: %v", err)
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("启动SFTP失败: %v", err)
+	}
+	return client, func() {
+		client.Close()
+		release()
+	}, nil
+}
+
+// 目录项
+type sftpEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"` // 八进制权限，如 0644
+	ModeStr string    `json:"mode_str"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+	IsLink  bool      `json:"is_link"`
+}
+
+func newSFTPEntry(dir string, fi os.FileInfo) sftpEntry {
+	return sftpEntry{
+		Name:    fi.Name(),
+		Path:    path.Join(dir, fi.Name()),
+		Size:    fi.Size(),
+		Mode:    fmt.Sprintf("%04o", fi.Mode().Perm()),
+		ModeStr: fi.Mode().String(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+		IsLink:  fi.Mode()&os.ModeSymlink != 0,
+	}
+}
+
+// 检查设备和 SFTP 权限并打开连接，失败时写入响应
+func sftpForRequest(c *gin.Context) (*CSMPDevice, *sftp.Client, func(), bool) {
+	dev, ok := lookupDevice(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
+		return nil, nil, nil, false
+	}
+	if !checkDeviceAction(c, dev, ActionSFTP) {
+		return nil, nil, nil, false
+	}
+	client, release, err := openDeviceSFTP(dev)
+	if err != nil {
+		if !writeHostKeyError(c, err) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return nil, nil, nil, false
+	}
+	return dev, client, release, true
+}
+
+// 远程路径必须是绝对路径，未指定时使用登录用户的主目录
+func sftpPath(client *sftp.Client, p string) (string, error) {
+	if p == "" {
+		return client.Getwd()
+	}
+	if !path.IsAbs(p) {
+		return "", errors.New("路径必须是绝对路径")
+	}
+	return path.Clean(p), nil
+}
+
+// 请求参数错误，与远程文件系统的错误区分开
+type sftpRequestError struct {
+	err error
+}
+
+func (e *sftpRequestError) Error() string { return e.err.Error() }
+
+// 把远程文件系统的错误转换为响应
+func writeSFTPError(c *gin.Context, err error) {
+	var reqErr *sftpRequestError
+	switch {
+	case errors.As(err, &reqErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在: " + err.Error()})
+	case errors.Is(err, os.ErrPermission):
+		c.JSON(http.StatusForbidden, gin.H{"error": "远程权限不足: " + err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// 列出目录，目录在前，按名称排序
+func sftpList(c *gin.Context) {
+	_, client, release, ok := sftpForRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	dir, err := sftpPath(client, c.Query("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	infos, err := client.ReadDir(dir)
+	if err != nil {
+		writeSFTPError(c, err)
+		return
+	}
+	entries := make([]sftpEntry, 0, len(infos))
+	for _, fi := range infos {
+		entries = append(entries, newSFTPEntry(dir, fi))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	c.JSON(http.StatusOK, gin.H{"path": dir, "entries": entries})
+}
+
+func sftpStat(c *gin.Context) {
+	_, client, release, ok := sftpForRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	p, err := sftpPath(client, c.Query("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fi, err := client.Stat(p)
+	if err != nil {
+		writeSFTPError(c, err)
+		return
+	}
+	entry := newSFTPEntry(path.Dir(p), fi)
+	entry.Path = p
+	c.JSON(http.StatusOK, entry)
+}
+
+// 下载文件，边读边发送，不在服务端缓存
+func sftpDownload(c *gin.Context) {
+	dev, client, release, ok := sftpForRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	p, err := sftpPath(client, c.Query("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := client.Open(p)
+	if err != nil {
+		recordAudit(c, AuditSFTPDownload, dev.ID, "", AuditFailure, p+" "+err.Error())
+		writeSFTPError(c, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeSFTPError(c, err)
+		return
+	}
+	if fi.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能下载目录"})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(p)}))
+	c.Header("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	c.Status(http.StatusOK)
+	n, err := io.Copy(c.Writer, f)
+	if err != nil {
+		recordAudit(c, AuditSFTPDownload, dev.ID, "", AuditFailure, fmt.Sprintf("%s %d/%d 字节 %v", p, n, fi.Size(), err))
+		return
+	}
+	recordAudit(c, AuditSFTPDownload, dev.ID, "", AuditSuccess, fmt.Sprintf("%s %d 字节", p, n))
+}
+
+// 上传文件到 path 指定的目录，表单中可以有多个 file 字段；
+// 按顺序读取表单并直接写入设备，浏览器看到的上传进度即为实际传输进度
+func sftpUpload(c *gin.Context) {
+	dev, client, release, ok := sftpForRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	dir, err := sftpPath(client, c.Query("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	overwrite := c.Query("overwrite") == "true"
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "需要 multipart/form-data 格式: " + err.Error()})
+		return
+	}
+
+	var uploaded []sftpEntry
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "uploaded": uploaded})
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		// 只取文件名，防止写到目标目录之外
+		name := path.Base(part.FileName())
+		if name == "." || name == ".." || name == "/" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "文件名无效: " + part.FileName(), "uploaded": uploaded})
+			return
+		}
+		target := path.Join(dir, name)
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if !overwrite {
+			// SFTP v3 没有“文件已存在”错误码，先检查再以 O_EXCL 打开
+			if _, err := client.Lstat(target); err == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "文件已存在: " + target, "uploaded": uploaded})
+				return
+			}
+			flags |= os.O_EXCL
+		}
+		f, err := client.OpenFile(target, flags)
+		if err != nil {
+			recordAudit(c, AuditSFTPUpload, dev.ID, "", AuditFailure, target+" "+err.Error())
+			writeSFTPError(c, err)
+			return
+		}
+		n, err := f.ReadFrom(part)
+		f.Close()
+		part.Close()
+		if err != nil {
+			recordAudit(c, AuditSFTPUpload, dev.ID, "", AuditFailure, fmt.Sprintf("%s %d 字节 %v", target, n, err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "上传 " + target + " 失败: " + err.Error(), "uploaded": uploaded})
+			return
+		}
+		recordAudit(c, AuditSFTPUpload, dev.ID, "", AuditSuccess, fmt.Sprintf("%s %d 字节", target, n))
+		if fi, err := client.Stat(target); err == nil {
+			uploaded = append(uploaded, newSFTPEntry(dir, fi))
+		}
+	}
+	if len(uploaded) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "没有上传文件"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"uploaded": uploaded})
+}
+
+// 文件操作请求
+type sftpRequest struct {
+	Path      string `json:"path"`
+	To        string `json:"to"`        // rename 的目标路径
+	Mode      string `json:"mode"`      // chmod 的八进制权限
+	Recursive bool   `json:"recursive"` // 删除非空目录
+}
+
+// 解析请求中的路径，失败时写入响应
+func bindSFTPRequest(c *gin.Context) (sftpRequest, bool) {
+	var req sftpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	for _, p := range []*string{&req.Path, &req.To} {
+		if *p == "" {
+			continue
+		}
+		if !path.IsAbs(*p) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "路径必须是绝对路径"})
+			return req, false
+		}
+		*p = path.Clean(*p)
+	}
+	if req.Path == "" || req.Path == "/" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少路径"})
+		return req, false
+	}
+	return req, true
+}
+
+// 执行修改操作并记入审计
+func sftpModify(c *gin.Context, action string, op func(*sftp.Client, sftpRequest) (string, error)) {
+	req, ok := bindSFTPRequest(c)
+	if !ok {
+		return
+	}
+	dev, client, release, ok := sftpForRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	detail, err := op(client, req)
+	if err != nil {
+		recordAudit(c, action, dev.ID, "", AuditFailure, detail+" "+err.Error())
+		writeSFTPError(c, err)
+		return
+	}
+	recordAudit(c, action, dev.ID, "", AuditSuccess, detail)
+	c.JSON(http.StatusOK, gin.H{"message": "操作成功"})
+}
+
+func sftpMkdir(c *gin.Context) {
+	sftpModify(c, AuditSFTPMkdir, func(client *sftp.Client, req sftpRequest) (string, error) {
+		return req.Path, client.Mkdir(req.Path)
+	})
+}
+
+func sftpRename(c *gin.Context) {
+	sftpModify(c, AuditSFTPRename, func(client *sftp.Client, req sftpRequest) (string, error) {
+		if req.To == "" {
+			return req.Path, &sftpRequestError{errors.New("缺少目标路径")}
+		}
+		return req.Path + " -> " + req.To, client.Rename(req.Path, req.To)
+	})
+}
+
+func sftpDelete(c *gin.Context) {
+	sftpModify(c, AuditSFTPDelete, func(client *sftp.Client, req sftpRequest) (string, error) {
+		if req.Recursive {
+			return req.Path + " 递归", client.RemoveAll(req.Path)
+		}
+		return req.Path, client.Remove(req.Path)
+	})
+}
+
+func sftpChmod(c *gin.Context) {
+	sftpModify(c, AuditSFTPChmod, func(client *sftp.Client, req sftpRequest) (string, error) {
+		mode, err := strconv.ParseUint(req.Mode, 8, 32)
+		if err != nil || mode > 07777 {
+			return req.Path, &sftpRequestError{errors.New("权限格式错误，应为八进制，如 0644")}
+		}
+		return fmt.Sprintf("%s %04o", req.Path, mode), client.Chmod(req.Path, os.FileMode(mode))
+	})
+}
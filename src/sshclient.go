@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// 设备 SSH 认证方式
+const (
+	SSHAuthPassword = "password" // 密码和键盘交互
+	SSHAuthKey      = "key"      // 私钥
+	SSHAuthAgent    = "agent"    // ssh-agent
+	SSHAuthCert     = "cert"     // 私钥 + OpenSSH 用户证书
+)
+
+// SSH 连接超时，包括 TCP 连接和握手
+const sshDialTimeout = 30 * time.Second
+
+// 跳板机，字段含义与设备的 SSH 字段相同
+type JumpHost struct {
+	Host          string `json:"host"`
+	Port          string `json:"port,omitempty"`
+	User          string `json:"user"`
+	AuthType      string `json:"auth_type,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Key           string `json:"key,omitempty"`
+	KeyPassphrase string `json:"key_passphrase,omitempty"`
+	Cert          string `json:"cert,omitempty"`
+	AgentSocket   string `json:"agent_socket,omitempty"`
+}
+
+// 设备自身的 SSH 连接参数
+func deviceEndpoint(dev *CSMPDevice) JumpHost {
+	return JumpHost{
+		Host:          dev.SSHHost,
+		Port:          dev.SSHPort,
+		User:          dev.SSHUser,
+		AuthType:      dev.SSHAuthType,
+		Password:      dev.SSHPass,
+		Key:           dev.SSHKey,
+		KeyPassphrase: dev.SSHKeyPassphrase,
+		Cert:          dev.SSHCert,
+		AgentSocket:   dev.SSHAgentSocket,
+	}
+}
+
+// SSH 地址，端口默认 22
+func (h *JumpHost) address() string {
+	port := h.Port
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(h.Host, port)
+}
+
+// 认证方式，未设置时为密码认证
+func (h *JumpHost) authType() string {
+	if h.AuthType == "" {
+		return SSHAuthPassword
+	}
+	return h.AuthType
+}
+
+// 是否配置了可用的登录信息
+func (h *JumpHost) hasCredentials() bool {
+	if h.Host == "" || h.User == "" {
+		return false
+	}
+	switch h.authType() {
+	case SSHAuthPassword:
+		return h.Password != ""
+	case SSHAuthKey:
+		return h.Key != ""
+	case SSHAuthCert:
+		return h.Key != "" && h.Cert != ""
+	case SSHAuthAgent:
+		return true
+	}
+	return false
+}
+
+// 解析私钥，设置了口令时用口令解密
+func (h *JumpHost) parseKey() (ssh.Signer, error) {
+	if h.Key == "" {
+		return nil, errors.New("未配置SSH私钥")
+	}
+	var signer ssh.Signer
+	var err error
+	if h.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(h.Key), []byte(h.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(h.Key))
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("SSH私钥已加密，需要填写私钥口令")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析SSH私钥失败: %v", err)
+	}
+	return signer, nil
+}
+
+// 解析用户证书，并与私钥组合成签名器
+func (h *JumpHost) parseCert(signer ssh.Signer) (ssh.Signer, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(h.Cert))
+	if err != nil {
+		return nil, fmt.Errorf("解析SSH证书失败: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("SSH证书格式错误: 不是 OpenSSH 证书")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("SSH证书不是用户证书")
+	}
+	if before := int64(cert.ValidBefore); cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= before {
+		return nil, errors.New("SSH证书已过期")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SSH证书与私钥不匹配: %v", err)
+	}
+	return certSigner, nil
+}
+
+// 校验认证配置，未填写的凭据不校验
+func (h *JumpHost) validate() error {
+	if h.Port != "" {
+		if _, err := strconv.ParseUint(h.Port, 10, 16); err != nil {
+			return fmt.Errorf("SSH端口错误: %s", h.Port)
+		}
+	}
+	switch h.authType() {
+	case SSHAuthPassword, SSHAuthAgent:
+		return nil
+	case SSHAuthKey:
+		if h.Key == "" {
+			return nil
+		}
+		_, err := h.parseKey()
+		return err
+	case SSHAuthCert:
+		if h.Key == "" || h.Cert == "" {
+			return nil
+		}
+		signer, err := h.parseKey()
+		if err != nil {
+			return err
+		}
+		_, err = h.parseCert(signer)
+		return err
+	}
+	return fmt.Errorf("未知的SSH认证方式: %s", h.AuthType)
+}
+
+// 认证方法；使用 ssh-agent 时返回的 closer 需要在握手完成后调用
+func (h *JumpHost) authMethods() ([]ssh.AuthMethod, func(), error) {
+	noop := func() {}
+	switch h.authType() {
+	case SSHAuthPassword:
+		password := h.Password
+		return []ssh.AuthMethod{
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		}, noop, nil
+
+	case SSHAuthKey:
+		signer, err := h.parseKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, noop, nil
+
+	case SSHAuthCert:
+		signer, err := h.parseKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		certSigner, err := h.parseCert(signer)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(certSigner)}, noop, nil
+
+	case SSHAuthAgent:
+		socket := h.AgentSocket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if socket == "" {
+			return nil, nil, errors.New("未配置 ssh-agent 套接字，且环境变量 SSH_AUTH_SOCK 为空")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("连接 ssh-agent 失败: %v", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, func() { conn.Close() }, nil
+	}
+	return nil, nil, fmt.Errorf("未知的SSH认证方式: %s", h.AuthType)
+}
+
+// 设备是否配置了可用的 SSH 登录信息，包括每个跳板机
+func deviceHasSSHCredentials(dev *CSMPDevice) bool {
+	for i := range dev.JumpHosts {
+		if !dev.JumpHosts[i].hasCredentials() {
+			return false
+		}
+	}
+	target := deviceEndpoint(dev)
+	return target.hasCredentials()
+}
+
+// 校验设备和跳板机的 SSH 认证配置，保存设备前调用
+func validateDeviceSSHAuth(dev *CSMPDevice) error {
+	for i := range dev.JumpHosts {
+		h := &dev.JumpHosts[i]
+		if h.Host == "" || h.User == "" {
+			return fmt.Errorf("跳板机 %d 缺少地址或用户名", i+1)
+		}
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("跳板机 %s: %v", h.Host, err)
+		}
+	}
+	target := deviceEndpoint(dev)
+	return target.validate()
+}
+
+// 设备 SSH 地址，端口默认 22
+func deviceSSHAddress(dev *CSMPDevice) string {
+	target := deviceEndpoint(dev)
+	return target.address()
+}
+
+// 通过 via 连接 h（via 为 nil 时直接连接），主机密钥按设备校验
+func dialSSHHop(dev *CSMPDevice, via *ssh.Client, h *JumpHost) (*ssh.Client, error) {
+	auth, closeAuth, err := h.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	// 认证只发生在握手阶段，连接建立后即可释放 ssh-agent 连接
+	defer closeAuth()
+	config := &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            auth,
+		HostKeyCallback: deviceHostKeyCallback(dev),
+		Timeout:         sshDialTimeout,
+	}
+	if via == nil {
+		return ssh.Dial("tcp", h.address(), config)
+	}
+
+	conn, err := via.Dial("tcp", h.address())
+	if err != nil {
+		return nil, err
+	}
+	// 经跳板机转发的连接没有拨号超时，握手超时后关闭连接
+	timer := time.AfterFunc(sshDialTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	c, chans, reqs, err := ssh.NewClientConn(conn, h.address(), config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// 依次连接设备的跳板机，返回最后一个跳板机的连接；没有跳板机时返回 nil
+func dialJumpChain(dev *CSMPDevice) (*ssh.Client, error) {
+	var via *ssh.Client
+	var chain []*ssh.Client
+	for i := range dev.JumpHosts {
+		h := &dev.JumpHosts[i]
+		client, err := dialSSHHop(dev, via, h)
+		if err != nil {
+			closeSSHChain(chain)
+			return nil, fmt.Errorf("跳板机 %s: %w", h.address(), err)
+		}
+		chain = append(chain, client)
+		via = client
+	}
+	if via != nil {
+		// 最后一个跳板机的连接关闭时，关闭前面的跳板机连接
+		go func() {
+			via.Wait()
+			closeSSHChain(chain)
+		}()
+	}
+	return via, nil
+}
+
+func closeSSHChain(chain []*ssh.Client) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].Close()
+	}
+}
+
+// 连接设备 SSH，配置了跳板机时经跳板机转发；所有 SSH 连接都应通过这里建立
+func dialSSH(dev *CSMPDevice) (*ssh.Client, error) {
+	jump, err := dialJumpChain(dev)
+	if err != nil {
+		return nil, err
+	}
+	target := deviceEndpoint(dev)
+	client, err := dialSSHHop(dev, jump, &target)
+	if err != nil {
+		if jump != nil {
+			jump.Close()
+		}
+		return nil, err
+	}
+	if jump != nil {
+		// 设备连接关闭时，一并关闭跳板机连接
+		go func() {
+			client.Wait()
+			jump.Close()
+		}()
+	}
+	return client, nil
+}
+
+// 跳板机转发的 TCP 连接，关闭时一并关闭跳板机连接
+type jumpConn struct {
+	net.Conn
+	jump *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.jump.Close()
+	return err
+}
+
+// 连接设备所在网络中的 TCP 地址，配置了跳板机时经跳板机转发
+func dialDeviceTCP(dev *CSMPDevice, address string) (net.Conn, error) {
+	if len(dev.JumpHosts) == 0 {
+		return net.DialTimeout("tcp", address, sshDialTimeout)
+	}
+	jump, err := dialJumpChain(dev)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := jump.Dial("tcp", address)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	return &jumpConn{Conn: conn, jump: jump}, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// 池中的 SSH 连接，同一设备的多个会话复用一条连接
+type pooledSSHClient struct {
+	deviceID  int
+	key       string
+	address   string
+	client    *ssh.Client
+	ready     chan struct{} // 拨号完成后关闭
+	err       error
+	refs      int
+	retired   bool // 已从池中移除，引用归零后关闭
+	closed    bool
+	createdAt time.Time
+	lastUsed  time.Time
+	sessions  int64
+}
+
+// 连接池统计
+type sshPoolStats struct {
+	Dials    int64 `json:"dials"`
+	Reuses   int64 `json:"reuses"`
+	Failures int64 `json:"failures"`
+	Evicted  int64 `json:"evicted"`
+}
+
+// 按设备管理的 SSH 连接池：复用连接、保活、失效重连、空闲淘汰
+type sshPool struct {
+	mu          sync.Mutex
+	clients     map[int]*pooledSSHClient
+	idleTimeout time.Duration
+	keepalive   time.Duration
+	stats       sshPoolStats
+}
+
+// 全局 SSH 连接池，在 main 中初始化
+var sshClients *sshPool
+
+func newSSHPool(idleTimeout, keepalive time.Duration) *sshPool {
+	return &sshPool{
+		clients:     make(map[int]*pooledSSHClient),
+		idleTimeout: idleTimeout,
+		keepalive:   keepalive,
+	}
+}
+
+// 设备连接参数的摘要，参数变化后不再复用旧连接
+func sshConfigKey(dev *CSMPDevice) string {
+	hops := append([]JumpHost{deviceEndpoint(dev)}, dev.JumpHosts...)
+	data, _ := json.Marshal(hops)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 获取设备的连接，没有可用连接时拨号；同一设备并发拨号时只拨一次
+func (p *sshPool) acquire(dev *CSMPDevice) (*pooledSSHClient, error) {
+	key := sshConfigKey(dev)
+	p.mu.Lock()
+	pc := p.clients[dev.ID]
+	if pc != nil && pc.key != key {
+		p.retireLocked(pc)
+		pc = nil
+	}
+	if pc != nil {
+		pc.refs++
+		p.stats.Reuses++
+		p.mu.Unlock()
+		<-pc.ready
+		if pc.err != nil {
+			p.release(pc)
+			return nil, pc.err
+		}
+		return pc, nil
+	}
+
+	now := time.Now()
+	pc = &pooledSSHClient{
+		deviceID:  dev.ID,
+		key:       key,
+		address:   deviceSSHAddress(dev),
+		ready:     make(chan struct{}),
+		refs:      1,
+		createdAt: now,
+		lastUsed:  now,
+	}
+	p.clients[dev.ID] = pc
+	p.stats.Dials++
+	p.mu.Unlock()
+
+	client, err := dialSSH(dev)
+
+	p.mu.Lock()
+	pc.client, pc.err = client, err
+	close(pc.ready)
+	if err != nil {
+		p.stats.Failures++
+		pc.refs--
+		p.retireLocked(pc)
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.mu.Unlock()
+
+	// 连接断开时从池中移除，下次使用时重新拨号
+	go func() {
+		client.Wait()
+		p.mu.Lock()
+		p.retireLocked(pc)
+		p.mu.Unlock()
+	}()
+	return pc, nil
+}
+
+func (p *sshPool) release(pc *pooledSSHClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.refs--
+	pc.lastUsed = time.Now()
+	if pc.retired {
+		p.closeIfUnusedLocked(pc)
+	}
+}
+
+// 从池中移除连接，正在使用的连接等引用归零后关闭，调用方需持有锁
+func (p *sshPool) retireLocked(pc *pooledSSHClient) {
+	if p.clients[pc.deviceID] == pc {
+		delete(p.clients, pc.deviceID)
+	}
+	pc.retired = true
+	p.closeIfUnusedLocked(pc)
+}
+
+func (p *sshPool) closeIfUnusedLocked(pc *pooledSSHClient) {
+	if pc.refs > 0 || pc.closed || pc.client == nil {
+		return
+	}
+	pc.closed = true
+	pc.client.Close()
+}
+
+// 在设备的池化连接上打开会话，返回的 release 关闭会话并归还连接；连接已失效时重连一次
+func (p *sshPool) Session(dev *CSMPDevice) (*ssh.Session, func(), error) {
+	for attempt := 0; ; attempt++ {
+		pc, err := p.acquire(dev)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := pc.client.NewSession()
+		if err == nil {
+			p.mu.Lock()
+			pc.sessions++
+			p.mu.Unlock()
+			return session, func() {
+				session.Close()
+				p.release(pc)
+			}, nil
+		}
+		p.mu.Lock()
+		p.retireLocked(pc)
+		p.mu.Unlock()
+		p.release(pc)
+		if attempt > 0 {
+			return nil, nil, err
+		}
+	}
+}
+
+// 池化连接上的转发通道，关闭时归还连接
+type pooledConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// 经设备的池化 SSH 连接打开 direct-tcpip 通道，address 由设备一侧解析；连接已失效时重连一次
+func (p *sshPool) Dial(dev *CSMPDevice, address string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		pc, err := p.acquire(dev)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := pc.client.Dial("tcp", address)
+		if err == nil {
+			return &pooledConn{Conn: conn, release: func() { p.release(pc) }}, nil
+		}
+		p.release(pc)
+		// 对端拒绝打开通道说明连接本身正常，不需要重连
+		var rejected *ssh.OpenChannelError
+		if errors.As(err, &rejected) || attempt > 0 {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.retireLocked(pc)
+		p.mu.Unlock()
+	}
+}
+
+// 移除设备的连接，设备删除时调用
+func (p *sshPool) Invalidate(deviceID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.clients[deviceID]; pc != nil {
+		p.retireLocked(pc)
+	}
+}
+
+// 定期发送保活请求并淘汰空闲连接，stop 关闭时退出
+func (p *sshPool) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var alive []*pooledSSHClient
+		p.mu.Lock()
+		for _, pc := range p.clients {
+			select {
+			case <-pc.ready:
+			default:
+				continue // 仍在拨号
+			}
+			if pc.refs == 0 && time.Since(pc.lastUsed) > p.idleTimeout {
+				p.stats.Evicted++
+				p.retireLocked(pc)
+				continue
+			}
+			alive = append(alive, pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range alive {
+			go p.ping(pc)
+		}
+	}
+}
+
+// 发送保活请求，超时未响应则关闭连接
+func (p *sshPool) ping(pc *pooledSSHClient) {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			return
+		}
+	case <-time.After(p.keepalive / 2):
+	}
+	// 连接已失效：关闭后 Wait 返回，连接随之从池中移除
+	pc.client.Close()
+}
+
+// 订阅设备变更，连接参数修改或设备删除后不再复用旧连接；
+// 刷新虚拟机信息等不涉及连接参数的修改保留连接
+func (p *sshPool) watchDevices(store DeviceStore) {
+	events, _ := store.Watch()
+	for ev := range events {
+		switch ev.Type {
+		case DeviceDeleted:
+			p.Invalidate(ev.Device.ID)
+		case DeviceUpdated:
+			p.invalidateChanged(&ev.Device)
+		}
+	}
+}
+
+// 只移除连接参数已变化的连接，与 acquire 中的判断一致
+func (p *sshPool) invalidateChanged(dev *CSMPDevice) {
+	key := sshConfigKey(dev)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.clients[dev.ID]; pc != nil && pc.key != key {
+		p.retireLocked(pc)
+	}
+}
+
+// 连接池状态
+type sshPoolEntry struct {
+	DeviceID  int       `json:"device_id"`
+	Address   string    `json:"address"`
+	Refs      int       `json:"refs"`
+	Sessions  int64     `json:"sessions"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+func (p *sshPool) Stats() (sshPoolStats, []sshPoolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := []sshPoolEntry{}
+	for _, pc := range p.clients {
+		select {
+		case <-pc.ready:
+		default:
+			continue
+		}
+		entries = append(entries, sshPoolEntry{
+			DeviceID:  pc.deviceID,
+			Address:   pc.address,
+			Refs:      pc.refs,
+			Sessions:  pc.sessions,
+			CreatedAt: pc.createdAt,
+			LastUsed:  pc.lastUsed,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeviceID < entries[j].DeviceID })
+	return p.stats, entries
+}
+
+func getSSHPoolStats(c *gin.Context) {
+	stats, entries := sshClients.Stats()
+	c.JSON(http.StatusOK, gin.H{"stats": stats, "clients": entries})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 令牌前缀，便于在日志和代码仓库扫描中识别
+const apiTokenPrefix = "icsdp_"
+
+// 最后使用时间写盘的最小间隔，避免每个请求都重写文件
+const tokenLastUsedFlush = time.Minute
+
+// 个人 API 令牌，只保存哈希
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"hash,omitempty"`
+	Role       string     `json:"role,omitempty"`
+	DeviceIDs  []int      `json:"device_ids,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+var errTokenNotFound = errors.New("令牌不存在")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 令牌存储，保存在 JSON 文件中
+type tokenStore struct {
+	mu        sync.Mutex
+	path      string
+	tokens    []APIToken
+	lastID    int // 已分配过的最大ID，删除后不回退
+	lastFlush time.Time
+}
+
+// 全局令牌存储，在 main 中初始化
+var tokens *tokenStore
+
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: []APIToken{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.lastID, err = unmarshalIDFile(data, "tokens", &s.tokens, func(t APIToken) int { return t.ID }); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	return s, nil
+}
+
+// 保存令牌到文件，调用方需持有锁
+func (s *tokenStore) save() error {
+	data, err := marshalIDFile("tokens", s.lastID, s.tokens)
+	if err != nil {
+		return err
+	}
+	s.lastFlush = time.Now()
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// 创建令牌，返回令牌明文（只在创建时可见）
+func (s *tokenStore) Create(t APIToken) (APIToken, string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	plain := apiTokenPrefix + secret
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	t.ID = s.lastID
+	t.Prefix = plain[:len(apiTokenPrefix)+6]
+	t.Hash = hashToken(plain)
+	t.CreatedAt = time.Now()
+
+	s.tokens = append(s.tokens, t)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		s.lastID--
+		return APIToken{}, "", err
+	}
+	return t, plain, nil
+}
+
+// 校验令牌明文，成功时记录最后使用时间
+func (s *tokenStore) Authenticate(plain string) (APIToken, bool) {
+	if !strings.HasPrefix(plain, apiTokenPrefix) {
+		return APIToken{}, false
+	}
+	hash := hashToken(plain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.tokens {
+		t := &s.tokens[i]
+		if t.Hash != hash {
+			continue
+		}
+		now := time.Now()
+		if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+			return APIToken{}, false
+		}
+		t.LastUsedAt = &now
+		if now.Sub(s.lastFlush) > tokenLastUsedFlush {
+			s.save()
+		}
+		return *t, true
+	}
+	return APIToken{}, false
+}
+
+func (s *tokenStore) ForUser(userID int) []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []APIToken{}
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func (s *tokenStore) List() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]APIToken{}, s.tokens...)
+}
+
+func (s *tokenStore) Get(id int) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return APIToken{}, errTokenNotFound
+}
+
+// 删除满足条件的令牌
+func (s *tokenStore) DeleteWhere(match func(t APIToken) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []APIToken{}
+	for _, t := range s.tokens {
+		if !match(t) {
+			kept = append(kept, t)
+		}
+	}
+	n := len(s.tokens) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	old := s.tokens
+	s.tokens = kept
+	if err := s.save(); err != nil {
+		s.tokens = old
+		return 0, err
+	}
+	return n, nil
+}
+
+// 使用 Bearer 令牌认证，返回按令牌范围收窄后的用户
+func authenticateBearer(c *gin.Context) (User, bool) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return User{}, false
+	}
+	t, ok := tokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	if !ok {
+		return User{}, false
+	}
+	u, err := users.Get(t.UserID)
+	if err != nil || u.Disabled {
+		return User{}, false
+	}
+	// 令牌角色不能超过用户当前角色
+	if t.Role != "" && roleAtLeast(u.Role, t.Role) {
+		u.Role = t.Role
+	}
+	u.scopeDevices = t.DeviceIDs
+	u.viaToken = true
+	return u, true
+}
+
+// 返回给浏览器的令牌信息，不包含哈希
+func redactToken(t APIToken) APIToken {
+	t.Hash = ""
+	return t
+}
+
+// 列出令牌：默认自己的令牌，管理员可以通过 all=1 查看全部
+func listTokens(c *gin.Context) {
+	u := currentUser(c)
+	list := tokens.ForUser(u.ID)
+	if c.Query("all") == "1" && u.Role == RoleAdmin && u.scopeDevices == nil {
+		list = tokens.List()
+	}
+	for i := range list {
+		list[i] = redactToken(list[i])
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func createToken(c *gin.Context) {
+	u := currentUser(c)
+	// 令牌不能再创建令牌，避免泄露后被用来长期驻留
+	if u.viaToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "请登录后创建令牌"})
+		return
+	}
+	var req struct {
+		Name          string `json:"name"`
+		Role          string `json:"role"`
+		DeviceIDs     []int  `json:"device_ids"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "令牌名称不能为空"})
+		return
+	}
+	if req.Role != "" && !roleAtLeast(u.Role, req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "令牌角色不能高于用户角色"})
+		return
+	}
+
+	t := APIToken{UserID: u.ID, Name: req.Name, Role: req.Role}
+	// 未指定设备时不限制设备范围（仍受授权约束）
+	if len(req.DeviceIDs) > 0 {
+		t.DeviceIDs = req.DeviceIDs
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		t.ExpiresAt = &expires
+	}
+	t, plain, err := tokens.Create(t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"token": plain,
+		"info":  redactToken(t),
+	})
+}
+
+// 吊销令牌：本人或管理员
+func revokeToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errTokenNotFound.Error()})
+		return
+	}
+	t, err := tokens.Get(id)
+	u := currentUser(c)
+	// 吊销他人的令牌属于全局管理操作，限定了设备范围的令牌不能执行
+	if err != nil || (t.UserID != u.ID && (u.Role != RoleAdmin || u.scopeDevices != nil)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errTokenNotFound.Error()})
+		return
+	}
+	if _, err := tokens.DeleteWhere(func(t APIToken) bool { return t.ID == id }); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "令牌已吊销"})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TOTP 参数（RFC 6238），与常见验证器应用的默认值一致
+const (
+	totpIssuer      = "ICS-DP"
+	totpPeriod      = 30
+	totpDigits      = 6
+	totpSkew        = 1 // 允许前后各一个时间窗口的时钟误差
+	recoveryCodeNum = 10
+
+	// 连续输错验证码达到次数后锁定一段时间，锁定期间不再校验
+	mfaMaxFailures = 5
+	mfaLockout     = 15 * time.Minute
+	mfaFailDelay   = 500 * time.Millisecond
+)
+
+// 敏感操作的二次验证策略，在 main 中根据启动参数设置
+var mfaPolicy struct {
+	WebShell   bool
+	DeviceEdit bool
+	Fresh      time.Duration
+}
+
+// 用于加密 TOTP 密钥等数据的主密钥，未配置时为 nil
+var masterBox *secretBox
+
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// 校验验证码，返回匹配的时间窗口计数；lastCounter 之前（含）的窗口视为已使用，防止重放
+func verifyTOTP(secret, code string, lastCounter int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := current + int64(i)
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func totpProvisioningURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRecoveryCodes() (plain, hashed []string, err error) {
+	for i := 0; i < recoveryCodeNum; i++ {
+		raw, err := randomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := raw[:5] + "-" + raw[5:]
+		plain = append(plain, code)
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return plain, hashed, nil
+}
+
+func sealTOTPSecret(secret string) (string, error) {
+	if masterBox == nil {
+		return secret, nil
+	}
+	return masterBox.encrypt(secret)
+}
+
+func openTOTPSecret(secret string) (string, error) {
+	if !isEncryptedSecret(secret) {
+		return secret, nil
+	}
+	if masterBox == nil {
+		return "", errors.New("TOTP 密钥已加密，但未配置主密钥")
+	}
+	return masterBox.decrypt(secret)
+}
+
+var (
+	errSecondFactorInvalid = errors.New("验证码错误")
+	errSecondFactorLocked  = errors.New("验证码错误次数过多，请稍后再试")
+)
+
+// 按用户统计连续失败的二次验证，step-up、停用和 X-TOTP-Code 请求头共用
+type mfaFailureLimiter struct {
+	mu       sync.Mutex
+	failures map[int]*mfaFailures
+}
+
+type mfaFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+var mfaLimiter = &mfaFailureLimiter{failures: make(map[int]*mfaFailures)}
+
+func (l *mfaFailureLimiter) locked(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[userID]
+	return ok && time.Now().Before(f.lockedUntil)
+}
+
+// 记录一次失败，返回是否因此被锁定
+func (l *mfaFailureLimiter) fail(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[userID]
+	if !ok {
+		f = &mfaFailures{}
+		l.failures[userID] = f
+	}
+	f.count++
+	if f.count < mfaMaxFailures {
+		return false
+	}
+	f.count = 0
+	f.lockedUntil = time.Now().Add(mfaLockout)
+	return true
+}
+
+func (l *mfaFailureLimiter) reset(userID int) {
+	l.mu.Lock()
+	delete(l.failures, userID)
+	l.mu.Unlock()
+}
+
+// 校验当前用户提交的验证码，失败时延迟响应、计数并写入审计，连续失败后锁定
+func checkSecondFactor(c *gin.Context, code string) error {
+	u := currentUser(c)
+	if mfaLimiter.locked(u.ID) {
+		recordAudit(c, AuditMFAFailure, 0, "", AuditDenied, "已锁定 "+c.FullPath())
+		return errSecondFactorLocked
+	}
+	err := verifySecondFactor(u.ID, code)
+	if err != errSecondFactorInvalid {
+		if err == nil {
+			mfaLimiter.reset(u.ID)
+		}
+		return err
+	}
+	time.Sleep(mfaFailDelay)
+	detail := c.FullPath()
+	if mfaLimiter.fail(u.ID) {
+		detail += fmt.Sprintf(" 连续失败 %d 次，锁定 %s", mfaMaxFailures, mfaLockout)
+	}
+	recordAudit(c, AuditMFAFailure, 0, "", AuditFailure, detail)
+	return err
+}
+
+// 校验失败时的响应状态码
+func secondFactorStatus(err error) int {
+	if err == errSecondFactorLocked {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusForbidden
+}
+
+// 校验用户提交的验证码或恢复码，成功时记录已使用的窗口或作废恢复码
+func verifySecondFactor(userID int, code string) error {
+	_, err := users.Update(userID, func(u *User) error {
+		if !u.TOTPEnabled {
+			return errors.New("未启用两步验证")
+		}
+		secret, err := openTOTPSecret(u.TOTPSecret)
+		if err != nil {
+			return err
+		}
+		if counter, ok := verifyTOTP(secret, code, u.TOTPLastCounter, time.Now()); ok {
+			u.TOTPLastCounter = counter
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, rc := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(append([]string{}, u.RecoveryCodes[:i]...), u.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return errSecondFactorInvalid
+	})
+	return err
+}
+
+// 敏感操作前检查二次验证，失败时写入 403 响应；
+// 要求当前会话在有效期内完成过二次验证，API 令牌请求可以通过 X-TOTP-Code 头即时验证
+func checkFreshMFA(c *gin.Context) bool {
+	u := currentUser(c)
+	if !u.TOTPEnabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "该操作需要两步验证，请先启用 TOTP", "mfa_required": true})
+		return false
+	}
+	if code := c.GetHeader("X-TOTP-Code"); code != "" {
+		if err := checkSecondFactor(c, code); err != nil {
+			c.JSON(secondFactorStatus(err), gin.H{"error": err.Error(), "mfa_required": true})
+			return false
+		}
+		return true
+	}
+	s := currentSession(c)
+	if s == nil || !sessions.steppedUpWithin(s.Token, mfaPolicy.Fresh) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "请先完成两步验证", "mfa_required": true})
+		return false
+	}
+	return true
+}
+
+// 要求新鲜二次验证的中间件，enabled 为 false 时不做检查
+func requireFreshMFA(enabled *bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if *enabled && !checkFreshMFA(c) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 两步验证状态
+func getTOTPStatus(c *gin.Context) {
+	u := currentUser(c)
+	s := currentSession(c)
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":         u.TOTPEnabled,
+		"recovery_codes":  len(u.RecoveryCodes),
+		"fresh":           s != nil && sessions.steppedUpWithin(s.Token, mfaPolicy.Fresh),
+		"webshell_mfa":    mfaPolicy.WebShell,
+		"device_edit_mfa": mfaPolicy.DeviceEdit,
+	})
+}
+
+// 开始绑定：生成待确认的密钥和供验证器扫码的 otpauth URI
+func enrollTOTP(c *gin.Context) {
+	u := currentUser(c)
+	if u.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "已启用两步验证，请先停用"})
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err == nil {
+		var sealed string
+		if sealed, err = sealTOTPSecret(secret); err == nil {
+			_, err = users.Update(u.ID, func(u *User) error {
+				u.TOTPSecret = sealed
+				return nil
+			})
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    totpProvisioningURI(u.Username, secret),
+	})
+}
+
+// 确认绑定：校验一次验证码后启用，并返回一次性的恢复码
+func confirmTOTP(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plain, hashed, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = users.Update(currentUser(c).ID, func(u *User) error {
+		if u.TOTPEnabled || u.TOTPSecret == "" {
+			return errors.New("请先开始绑定")
+		}
+		secret, err := openTOTPSecret(u.TOTPSecret)
+		if err != nil {
+			return err
+		}
+		counter, ok := verifyTOTP(secret, req.Code, 0, time.Now())
+		if !ok {
+			return errors.New("验证码错误")
+		}
+		u.TOTPEnabled = true
+		u.TOTPLastCounter = counter
+		u.RecoveryCodes = hashed
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": plain})
+}
+
+// 停用两步验证，需要提交有效的验证码或恢复码
+func disableTOTP(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u := currentUser(c)
+	if err := checkSecondFactor(c, req.Code); err != nil {
+		c.JSON(secondFactorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := users.Update(u.ID, func(u *User) error {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastCounter = 0
+		u.RecoveryCodes = nil
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "两步验证已停用"})
+}
+
+// 二次验证：校验成功后在当前会话中记录验证时间
+func stepUp(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s := currentSession(c)
+	if s == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API 令牌请使用 X-TOTP-Code 请求头"})
+		return
+	}
+	if err := checkSecondFactor(c, req.Code); err != nil {
+		c.JSON(secondFactorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	sessions.markStepUp(s.Token)
+	c.JSON(http.StatusOK, gin.H{"message": "验证成功", "valid_seconds": int(mfaPolicy.Fresh.Seconds())})
+}
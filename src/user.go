@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 平台角色，权限依次递增
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// 判断 role 是否具有 required 角色的权限
+func roleAtLeast(role, required string) bool {
+	return roleRank[role] >= roleRank[required] && roleRank[role] > 0
+}
+
+// 平台用户
+type User struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	// 账号来源，空表示本地账号，ldap 表示登录时由目录服务自动创建
+	Source    string    `json:"source,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// 两步验证：TOTP 密钥（配置主密钥时加密保存）、最近使用的时间窗口和恢复码哈希
+	TOTPEnabled     bool     `json:"totp_enabled"`
+	TOTPSecret      string   `json:"totp_secret,omitempty"`
+	TOTPLastCounter int64    `json:"totp_last_counter,omitempty"`
+	RecoveryCodes   []string `json:"recovery_codes,omitempty"`
+
+	// 以下字段只在 API 令牌认证的请求中设置，不保存
+	scopeDevices []int
+	viaToken     bool
+}
+
+// 设备是否在 API 令牌的范围内，未限定范围时总是返回 true
+func (u *User) inDeviceScope(id int) bool {
+	if u.scopeDevices == nil {
+		return true
+	}
+	for _, d := range u.scopeDevices {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errUserNotFound = errors.New("用户不存在")
+	errUserExists   = errors.New("用户名已存在")
+)
+
+// 用户存储，保存在 JSON 文件中
+type userStore struct {
+	mu    sync.Mutex
+	path  string
+	users []User
+	// 已分配过的最大ID，删除用户后也不回退，避免新账号继承旧账号的授权和令牌
+	lastID int
+}
+
+// 全局用户存储，在 main 中初始化
+var users *userStore
+
+func newUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, users: []User{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.lastID, err = unmarshalIDFile(data, "users", &s.users, func(u User) int { return u.ID }); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	return s, nil
+}
+
+// 保存用户到文件，调用方需持有锁
+func (s *userStore) save() error {
+	data, err := marshalIDFile("users", s.lastID, s.users)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+func (s *userStore) Get(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+func (s *userStore) GetByName(username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+func (s *userStore) List() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]User{}, s.users...)
+}
+
+func (s *userStore) Create(u User, password string) (User, error) {
+	if err := validateUser(u); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if strings.EqualFold(existing.Username, u.Username) {
+			return User{}, errUserExists
+		}
+	}
+	s.lastID++
+	u.ID = s.lastID
+	u.PasswordHash = hash
+	u.CreatedAt = time.Now()
+
+	s.users = append(s.users, u)
+	if err := s.save(); err != nil {
+		s.users = s.users[:len(s.users)-1]
+		s.lastID--
+		return User{}, err
+	}
+	return u, nil
+}
+
+// 外部目录用户登录成功后创建或同步本地记录，角色以目录中的组为准
+func (s *userStore) UpsertExternal(username, source, role string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		u := &s.users[i]
+		if !strings.EqualFold(u.Username, username) {
+			continue
+		}
+		// 同名本地账号不允许被目录账号接管
+		if u.Source != source {
+			return User{}, fmt.Errorf("用户 %s 已存在且来源不同", username)
+		}
+		if u.Role != role {
+			old := u.Role
+			u.Role = role
+			if err := s.save(); err != nil {
+				u.Role = old
+				return User{}, err
+			}
+		}
+		return *u, nil
+	}
+
+	s.lastID++
+	u := User{ID: s.lastID, Username: username, Role: role, Source: source, CreatedAt: time.Now()}
+	s.users = append(s.users, u)
+	if err := s.save(); err != nil {
+		s.users = s.users[:len(s.users)-1]
+		s.lastID--
+		return User{}, err
+	}
+	return u, nil
+}
+
+// Update 在锁内修改用户，fn 返回错误时放弃修改
+func (s *userStore) Update(id int, fn func(u *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID != id {
+			continue
+		}
+		old := s.users[i]
+		u := old
+		if err := fn(&u); err != nil {
+			return User{}, err
+		}
+		u.ID = id
+		if err := validateUser(u); err != nil {
+			return User{}, err
+		}
+		s.users[i] = u
+		if err := s.save(); err != nil {
+			s.users[i] = old
+			return User{}, err
+		}
+		return u, nil
+	}
+	return User{}, errUserNotFound
+}
+
+func (s *userStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID != id {
+			continue
+		}
+		old := s.users
+		s.users = append(append([]User{}, s.users[:i]...), s.users[i+1:]...)
+		if err := s.save(); err != nil {
+			s.users = old
+			return err
+		}
+		return nil
+	}
+	return errUserNotFound
+}
+
+func validateUser(u User) error {
+	if strings.TrimSpace(u.Username) == "" {
+		return errors.New("用户名不能为空")
+	}
+	if _, ok := roleRank[u.Role]; !ok {
+		return fmt.Errorf("未知角色: %s", u.Role)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", errors.New("密码长度至少8位")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(u User, password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// 首次启动没有任何用户时创建管理员账号
+func bootstrapAdmin(s *userStore) error {
+	if len(s.List()) > 0 {
+		return nil
+	}
+	password := os.Getenv("ICS_ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		buf := make([]byte, 12)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	if _, err := s.Create(User{Username: "admin", Role: RoleAdmin}, password); err != nil {
+		return err
+	}
+	if generated {
+		fmt.Printf("已创建初始管理员 admin，密码: %s （请登录后立即修改）\n", password)
+	}
+	return nil
+}
+
+// 返回给浏览器的用户信息，不包含密码哈希
+func redactUser(u User) User {
+	u.PasswordHash = ""
+	u.TOTPSecret = ""
+	u.TOTPLastCounter = 0
+	u.RecoveryCodes = nil
+	return u
+}
+
+// 用户管理请求
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	// 重置两步验证，用于用户丢失验证器的情况
+	ResetTOTP bool `json:"reset_totp"`
+}
+
+func listUsers(c *gin.Context) {
+	list := users.List()
+	for i := range list {
+		list[i] = redactUser(list[i])
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func createUser(c *gin.Context) {
+	var req userRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := users.Create(User{Username: req.Username, Role: req.Role, Disabled: req.Disabled}, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, redactUser(u))
+}
+
+func updateUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	var req userRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var hash string
+	if req.Password != "" {
+		if hash, err = hashPassword(req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	u, err := users.Update(id, func(u *User) error {
+		if req.Username != "" {
+			u.Username = req.Username
+		}
+		if req.Role != "" {
+			u.Role = req.Role
+		}
+		u.Disabled = req.Disabled
+		if hash != "" {
+			u.PasswordHash = hash
+		}
+		if req.ResetTOTP {
+			u.TOTPEnabled = false
+			u.TOTPSecret = ""
+			u.TOTPLastCounter = 0
+			u.RecoveryCodes = nil
+		}
+		return nil
+	})
+	if err == errUserNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 禁用账号或修改密码后使其已有会话失效
+	if u.Disabled || hash != "" || req.ResetTOTP {
+		sessions.revokeUser(u.ID)
+	}
+	c.JSON(http.StatusOK, redactUser(u))
+}
+
+func deleteUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if id == currentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能删除当前登录的用户"})
+		return
+	}
+	if _, err := users.Get(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	// 先清理用户拥有的授权、令牌、定时任务和端口转发，任何一步失败都保留账号，可以重试
+	if _, err := grants.DeleteWhere(func(g Grant) bool { return g.UserID == id }); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "清理授权失败: " + err.Error()})
+		return
+	}
+	if _, err := tokens.DeleteWhere(func(t APIToken) bool { return t.UserID == id }); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "清理令牌失败: " + err.Error()})
+		return
+	}
+	if _, err := schedules.DeleteWhere(func(sc Schedule) bool { return sc.OwnerID == id }); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "清理定时任务失败: " + err.Error()})
+		return
+	}
+	for _, f := range forwards.List() {
+		if f.OwnerID == id {
+			f.Close("用户已删除")
+		}
+	}
+	if err := users.Delete(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	sessions.revokeUser(id)
+	c.JSON(http.StatusOK, gin.H{"message": "用户已删除"})
+}
+
+// 当前用户修改自己的密码
+func changeOwnPassword(c *gin.Context) {
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	me := currentUser(c)
+	u, err := users.Get(me.ID)
+	if err != nil || !checkPassword(u, req.OldPassword) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "原密码错误"})
+		return
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := users.Update(me.ID, func(u *User) error {
+		u.PasswordHash = hash
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "密码已修改"})
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,7 +18,11 @@ type TCPSession struct {
 	Conn      net.Conn
 	isActive  bool
 	WebSocket *websocket.Conn
+	browser   *wsStream // 握手后剩余的浏览器数据从这里继续读取
+	recorder  *vncRecorder
 	LastUsed  time.Time
+	// 只读模式下过滤浏览器输入，nil 表示允许完全控制
+	viewOnly *rfbViewOnlyFilter
 }
 
 var tcpSessions = make(map[string]*TCPSession)
@@ -25,16 +30,24 @@ var tcpSessionsMutex sync.RWMutex
 
 // WebSocket upgrader
 var upgraderVNC = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Restrict in production
-	},
+	CheckOrigin: checkOrigin,
 }
 
 // Handle WebSocket to TCP forwarding
 func handleVNCWebSocket(c *gin.Context) {
-	address := c.Query("address")
-	if address == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少设备地址"})
+	// 连接目标由 getVNCAddress 签发的一次性票据决定，不接受页面传入的地址
+	ticket, err := vncTickets.Redeem(c.Query("token"), currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	config, ok := lookupDevice(strconv.Itoa(ticket.DeviceID))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
+		return
+	}
+	// 票据签发后权限可能已被收回
+	if !checkDeviceAction(c, config, ActionVNC) {
 		return
 	}
 	// Upgrade to WebSocket
@@ -45,21 +58,33 @@ func handleVNCWebSocket(c *gin.Context) {
 	}
 	defer ws.Close()
 
-	host, port, err := net.SplitHostPort(address)
-	if err == nil {
-		if _, err := fmt.Sscanf(port, "%d", new(int)); err == nil {
-			var portNum int
-			fmt.Sscanf(port, "%d", &portNum)
-			address = fmt.Sprintf("%s:%d", host, portNum+5900)
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "设备地址错误"})
-			return
-		}
-	}
+	address, vm := ticket.Address, ticket.VM
+	browser := &wsStream{ws: ws}
+
 	// Connect to TCP server (replace with your TCP server address)
-	tcpConn, err := net.Dial("tcp", address)
+	tcpConn, err := dialDeviceVNC(config, address)
 	if err != nil {
-		ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("TCP connection failed: %v", err)))
+		recordAudit(c, AuditVNCConnect, config.ID, vm, AuditFailure, address+" "+err.Error())
+		rejectVNCBrowser(browser, fmt.Sprintf("连接VNC服务器失败: %v", err))
+		return
+	}
+
+	// 代理用设备保存的密码完成 VNC 认证，浏览器侧只提供无认证方式，VNC 密码不下发到浏览器
+	// 经 SSH 转发的连接不支持 deadline，握手超时后直接关闭两侧连接
+	timer := time.AfterFunc(rfbHandshakeTimeout, func() {
+		tcpConn.Close()
+		ws.Close()
+	})
+	if err := rfbServerHandshake(tcpConn, config.VNCPass); err != nil {
+		timer.Stop()
+		tcpConn.Close()
+		recordAudit(c, AuditVNCConnect, config.ID, vm, AuditFailure, address+" "+err.Error())
+		rejectVNCBrowser(browser, err.Error())
+		return
+	}
+	err = rfbBrowserHandshake(browser)
+	if !timer.Stop() || err != nil {
+		tcpConn.Close()
 		return
 	}
 
@@ -69,8 +94,27 @@ func handleVNCWebSocket(c *gin.Context) {
 		Conn:      tcpConn,
 		isActive:  true,
 		WebSocket: ws,
+		browser:   browser,
 		LastUsed:  time.Now(),
 	}
+	if ticket.ViewOnly {
+		session.viewOnly = &rfbViewOnlyFilter{}
+	}
+	session.recorder = startVNCRecording(c, config, vm)
+	defer session.recorder.Close()
+
+	detail := address
+	if session.viewOnly != nil {
+		detail += " 只读"
+	}
+	if session.recorder != nil {
+		detail += " 录像 " + session.recorder.rec.ID
+	}
+	recordAudit(c, AuditVNCConnect, config.ID, vm, AuditSuccess, detail)
+	connectedAt := time.Now()
+	defer func() {
+		recordAudit(c, AuditVNCDisconnect, config.ID, vm, AuditSuccess, "时长 "+time.Since(connectedAt).Round(time.Second).String())
+	}()
 
 	// Store session
 	tcpSessionsMutex.Lock()
@@ -108,21 +152,33 @@ func handleTCPOutput(session *TCPSession) {
 				fmt.Printf("WebSocket write failed: %v", err)
 				break
 			}
+			session.recorder.Write(buffer[:n])
 		}
 	}
 }
 
 // Forward WebSocket input to TCP
 func handleVNCWebSocketInput(session *TCPSession) {
+	buffer := make([]byte, 32*1024)
 	for session.isActive {
-		_, message, err := session.WebSocket.ReadMessage()
+		n, err := session.browser.Read(buffer)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				fmt.Printf("WebSocket read error: %v", err)
 			}
 			break
 		}
+		message := buffer[:n]
 		session.LastUsed = time.Now()
+		if session.viewOnly != nil {
+			if message, err = session.viewOnly.Filter(message); err != nil {
+				fmt.Printf("VNC view-only filter: %v", err)
+				break
+			}
+			if len(message) == 0 {
+				continue
+			}
+		}
 		if _, err := session.Conn.Write(message); err != nil {
 			fmt.Printf("TCP write failed: %v", err)
 			break
@@ -130,6 +186,46 @@ func handleVNCWebSocketInput(session *TCPSession) {
 	}
 }
 
+// 按 RFB 协议告知浏览器连接失败的原因，noVNC 会显示在页面上
+func rejectVNCBrowser(browser *wsStream, reason string) {
+	browser.ws.SetReadDeadline(time.Now().Add(rfbHandshakeTimeout))
+	rfbBrowserReject(browser, reason)
+}
+
+// 把 websocket 二进制消息当作字节流读写，用于代理与浏览器之间的 RFB 握手
+type wsStream struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		_, message, err := s.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		s.buf = message
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 连接设备的 VNC 端口：配置了 vnc_via_ssh 时经设备的池化 SSH 连接转发，否则直接（或经跳板机）连接
+func dialDeviceVNC(dev *CSMPDevice, address string) (net.Conn, error) {
+	if dev.VNCViaSSH {
+		return sshClients.Dial(dev, address)
+	}
+	return dialDeviceTCP(dev, address)
+}
+
 // Close TCP session
 func closeTCPSession(session *TCPSession) {
 	if session == nil {
@@ -2,12 +2,12 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/ssh"
 )
 
 func getVNCAddress(c *gin.Context) {
@@ -21,68 +21,87 @@ func getVNCAddress(c *gin.Context) {
 	}
 
 	// 查找 config
-	var config *CSMPDevice
-	for _, cfg := range csmpDevices {
-		if fmt.Sprintf("%v", cfg.ID) == deviceId {
-			config = &cfg
-			break
-		}
-	}
-	if config == nil {
+	config, ok := lookupDevice(deviceId)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
 		return
 	}
-
-	// 准备多种认证方法
-	authMethods := []ssh.AuthMethod{
-		ssh.Password(config.SSHPass),
-	}
-	// SSH连接配置
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUser,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-
-	// 连接 SSH
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.SSHHost, config.SSHPort), sshConfig)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH connection failed"})
+	if !checkDeviceAction(c, config, ActionVNC) {
 		return
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
+	// 两次命令复用同一条池化连接
+	session, release, err := sshClients.Session(config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH session failed"})
+		if writeHostKeyError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH connection failed"})
 		return
 	}
-	defer session.Close()
+	defer release()
 
-	cmd := fmt.Sprintf("virsh list --all --name | grep . | while read vm; do virsh dumpxml \"$vm\" | grep -q \"<nova:name>%s</nova:name>\" && echo \"$vm\"; done", itemName)
+	// itemName 来自请求参数，按固定字符串匹配并整体加引号，不能被 shell 解释
+	cmd := fmt.Sprintf("virsh list --all --name | grep . | while read vm; do virsh dumpxml \"$vm\" | grep -qF -- %s && echo \"$vm\"; done",
+		shellQuote("<nova:name>"+itemName+"</nova:name>"))
 	output, err := session.CombinedOutput(cmd)
 	if err != nil && len(output) == 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "get VM name failed"})
 		return
 	}
 
-	session2, err := client.NewSession()
+	session2, release2, err := sshClients.Session(config)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "SSH session failed"})
 		return
 	}
-	defer session2.Close()
-	cmd = fmt.Sprintf("virsh vncdisplay %s", strings.TrimSpace(string(output)))
+	defer release2()
+	// 只取第一个匹配的虚拟机，远端输出同样加引号
+	vm := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0])
+	if vm == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "虚拟机不存在"})
+		return
+	}
+	cmd = fmt.Sprintf("virsh vncdisplay %s", shellQuote(vm))
 	output, err = session2.CombinedOutput(cmd)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "get VNC display failed"})
 		return
 	}
 
-	vncAddress := config.SSHHost + strings.TrimSpace(string(output))
+	// vncdisplay 输出 ":0" 或 "127.0.0.1:0"，只取显示编号，端口为 5900+编号
+	display := strings.TrimSpace(string(output))
+	if i := strings.LastIndex(display, ":"); i >= 0 {
+		display = display[i+1:]
+	}
+	num, err := strconv.Atoi(display)
+	if err != nil || num < 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "get VNC display failed"})
+		return
+	}
+	host := config.SSHHost
+	// VNC 只监听本地地址时，经设备的 SSH 连接转发
+	if config.VNCViaSSH {
+		host = "127.0.0.1"
+	}
+
+	// viewer 角色只能查看，代理会丢弃其键盘鼠标输入
+	viewOnly := !roleAtLeast(currentUser(c).Role, RoleOperator)
+	token, err := vncTickets.Issue(vncTicket{
+		DeviceID: config.ID,
+		VM:       itemName,
+		UserID:   currentUser(c).ID,
+		Address:  net.JoinHostPort(host, strconv.Itoa(5900+num)),
+		ViewOnly: viewOnly,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 不返回地址和密码，页面只拿到一次性票据
 	c.JSON(http.StatusOK, gin.H{
-		"address": vncAddress,
-		"pass":    config.VNCPass,
+		"token":      token,
+		"expires_in": int(vncTicketTTL.Seconds()),
+		"view_only":  viewOnly,
 	})
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VNC 录像文件格式：文件头之后是若干帧，每帧为
+// 距会话开始的毫秒数(uint32) + 数据长度(uint32) + 服务器发往浏览器的数据，均为大端序
+const vncRecordingMagic = "ICSVNC1\n"
+
+// 录制发往浏览器的 RFB 数据流，回放时交给 noVNC 解码
+type vncRecorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	rec   Recording
+	start time.Time
+	size  int64
+}
+
+// 开始录制 VNC 会话，未开启录制或创建文件失败时返回 nil，不影响会话本身
+func startVNCRecording(c *gin.Context, dev *CSMPDevice, vm string) *vncRecorder {
+	if !recordVNC {
+		return nil
+	}
+	user := currentUser(c)
+	f, rec, err := recordings.Create(Recording{
+		Kind:     RecordingVNC,
+		DeviceID: dev.ID,
+		VM:       vm,
+		UserID:   user.ID,
+		User:     user.Username,
+	})
+	if err != nil {
+		log.Printf("创建 VNC 录像失败: %v", err)
+		return nil
+	}
+	r := &vncRecorder{file: f, w: bufio.NewWriter(f), rec: rec, start: time.Now()}
+	r.w.WriteString(vncRecordingMagic)
+	r.size = int64(len(vncRecordingMagic))
+	// 浏览器一侧的握手由代理完成，录像以同样的无认证握手开头，回放时 noVNC 可以直接解码
+	r.Write([]byte("RFB 003.008\n"))
+	r.Write([]byte{1, rfbSecurityNone})
+	r.Write([]byte{0, 0, 0, 0})
+	return r
+}
+
+// 写入一帧，写入失败时停止录制
+func (r *vncRecorder) Write(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(time.Since(r.start).Milliseconds()))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(data)))
+	r.w.Write(header[:])
+	if _, err := r.w.Write(data); err != nil {
+		log.Printf("写入 VNC 录像 %s 失败: %v", r.rec.ID, err)
+		r.w = nil
+		return
+	}
+	r.size += int64(len(header) + len(data))
+}
+
+func (r *vncRecorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil {
+		r.w.Flush()
+		r.w = nil
+	}
+	r.file.Close()
+	if err := recordings.Finish(r.rec, r.size); err != nil {
+		log.Printf("保存 VNC 录像 %s 失败: %v", r.rec.ID, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// VNC 票据有效期，页面拿到票据后应立即建立 websocket 连接
+const vncTicketTTL = 30 * time.Second
+
+// 一次性 VNC 票据：连接目标在服务端解析，浏览器只持有不透明的票据
+type vncTicket struct {
+	DeviceID  int
+	VM        string
+	UserID    int
+	Address   string // 设备一侧的 VNC 地址，host:port
+	ViewOnly  bool
+	ExpiresAt time.Time
+}
+
+var errVNCTicketInvalid = errors.New("VNC票据无效或已过期，请重新打开")
+
+// 内存中的票据表，重启后全部失效
+type vncTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]*vncTicket
+}
+
+var vncTickets = &vncTicketStore{tickets: make(map[string]*vncTicket)}
+
+// 签发票据，顺带清理过期票据
+func (s *vncTicketStore) Issue(t vncTicket) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	t.ExpiresAt = now.Add(vncTicketTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.tickets {
+		if now.After(v.ExpiresAt) {
+			delete(s.tickets, k)
+		}
+	}
+	s.tickets[token] = &t
+	return token, nil
+}
+
+// 兑换票据：无论成功与否票据都立即作废，且只能由签发时的用户使用
+func (s *vncTicketStore) Redeem(token string, userID int) (vncTicket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[token]
+	if !ok {
+		return vncTicket{}, errVNCTicketInvalid
+	}
+	delete(s.tickets, token)
+	if t.UserID != userID || time.Now().After(t.ExpiresAt) {
+		return vncTicket{}, errVNCTicketInvalid
+	}
+	return *t, nil
+}
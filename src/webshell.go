@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,16 +18,81 @@ import (
 
 // SSH会话结构
 type SSHSession struct {
-	Client        *ssh.Client
-	Session       *ssh.Session
-	StdinPipe     io.WriteCloser
-	StdoutPipe    io.Reader
-	StderrPipe    io.Reader
-	Config        *CSMPDevice
-	CreatedAt     time.Time
-	LastUsed      time.Time
-	isActive      bool
-	WebSocketConn *websocket.Conn
+	ID         string
+	Session    *ssh.Session
+	StdinPipe  io.WriteCloser
+	StdoutPipe io.Reader
+	StderrPipe io.Reader
+	Config     *CSMPDevice
+	CreatedAt  time.Time
+	LastUsed   time.Time
+	isActive   bool
+	release    func() // 关闭会话并归还池化连接
+	recorder   *castRecorder
+	Cols       int
+	Rows       int
+	OwnerID    int
+	Owner      string
+	ownerIP    string
+
+	// 连接到会话的浏览器和共享链接，所有者之外的参与者通过共享链接加入
+	mu         sync.Mutex
+	clients    map[string]*webShellClient
+	shares     map[string]*webShellShare
+	kicked     map[int]bool // 被移出的用户，不能再通过任何共享链接加入
+	DetachedAt time.Time
+	graceTimer *time.Timer // 所有者断开后的保留计时，恢复连接时停止
+	closeOnce  sync.Once
+
+	// 最近的输出，新连接的浏览器先回放这部分内容
+	outMu      sync.Mutex
+	scrollback *scrollbackBuffer
+}
+
+// WebShell websocket 消息：浏览器以 JSON 文本消息发送输入、窗口大小和心跳，
+// 服务器以二进制消息发送终端输出，以 JSON 文本消息回复心跳
+type webShellMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+
+	// 连接建立后服务器发送的会话信息
+	SessionID string `json:"session_id,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Owner     bool   `json:"owner,omitempty"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+	Device    string `json:"device,omitempty"`
+
+	Participants []*webShellClient `json:"participants,omitempty"`
+}
+
+const (
+	webShellData         = "data"
+	webShellResize       = "resize"
+	webShellPing         = "ping"
+	webShellPong         = "pong"
+	webShellClose        = "close"        // 所有者结束会话，不再保留
+	webShellSession      = "session"      // 服务器发送：会话信息
+	webShellParticipants = "participants" // 服务器发送：参与者列表变化
+)
+
+// 终端类型和默认窗口大小
+const (
+	webShellTerm        = "xterm-256color"
+	webShellDefaultCols = 80
+	webShellDefaultRows = 24
+)
+
+// 限制窗口大小在合理范围内，无效值使用默认值
+func clampTermSize(cols, rows int) (int, int) {
+	if cols <= 0 {
+		cols = webShellDefaultCols
+	}
+	if rows <= 0 {
+		rows = webShellDefaultRows
+	}
+	return min(max(cols, 10), 500), min(max(rows, 5), 200)
 }
 
 // WebShell连接请求
@@ -48,13 +116,21 @@ var sshSessionsMutex sync.RWMutex
 
 // WebSocket升级器
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 允许所有源，生产环境中应该限制
-	},
+	CheckOrigin: checkOrigin,
 }
 
 // WebShell WebSocket处理
 func handleWebShellWebSocket(c *gin.Context) {
+	// 通过共享链接加入他人的会话，或按会话ID恢复自己断开的会话
+	if token := c.Query("share"); token != "" {
+		attachSharedWebShell(c, token)
+		return
+	}
+	if id := c.Query("session"); id != "" {
+		resumeWebShell(c, id)
+		return
+	}
+
 	deviceIdStr := c.Query("device_id")
 	if deviceIdStr == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少设备ID"})
@@ -62,18 +138,14 @@ func handleWebShellWebSocket(c *gin.Context) {
 	}
 
 	// 获取设备配置
-	var config *CSMPDevice
-	for _, cfg := range csmpDevices {
-		if fmt.Sprintf("%d", cfg.ID) == deviceIdStr {
-			config = &cfg
-			break
-		}
-	}
-
-	if config == nil {
+	config, ok := lookupDevice(deviceIdStr)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "设备配置不存在"})
 		return
 	}
+	if !checkDeviceAction(c, config, ActionWebShell) {
+		return
+	}
 
 	// 升级到WebSocket连接
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -83,203 +155,165 @@ func handleWebShellWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	// 建立SSH连接
-	sshSession, err := createSSHSession(config, conn)
+	// 建立SSH连接，终端大小由页面传入
+	cols, _ := strconv.Atoi(c.Query("cols"))
+	rows, _ := strconv.Atoi(c.Query("rows"))
+	cols, rows = clampTermSize(cols, rows)
+	sshSession, err := createSSHSession(config, cols, rows)
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("SSH连接失败: %v", err)))
+		recordAudit(c, AuditWebShellConnect, config.ID, "", AuditFailure, err.Error())
+		// 主机密钥变化时给出明确提示，而不是笼统的连接失败
+		var mismatch *HostKeyMismatchError
+		var unknown *HostKeyUnknownError
+		switch {
+		case errors.As(err, &mismatch):
+			conn.WriteMessage(websocket.BinaryMessage, []byte("\r\n@@@ 警告：远程主机密钥已变化！@@@\r\n"+mismatch.Error()+"\r\n"))
+		case errors.As(err, &unknown):
+			conn.WriteMessage(websocket.BinaryMessage, []byte("\r\n"+unknown.Error()+"\r\n"))
+		default:
+			conn.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("SSH连接失败: %v", err)))
+		}
 		return
 	}
-	defer closeSSHSession(sshSession)
+	user := currentUser(c)
+	sshSession.OwnerID, sshSession.Owner, sshSession.ownerIP = user.ID, user.Username, c.ClientIP()
+	sshSession.recorder = startWebShellRecording(c, config, cols, rows, webShellTerm)
+	detail := config.SSHHost + " 会话 " + sshSession.ID
+	if sshSession.recorder != nil {
+		detail += " 录像 " + sshSession.recorder.rec.ID
+	}
+	recordAudit(c, AuditWebShellConnect, config.ID, "", AuditSuccess, detail)
 
-	// 生成会话ID并保存
-	sessionID := fmt.Sprintf("ws_%s_%d", deviceIdStr, time.Now().Unix())
+	// 保存会话，共享链接和恢复连接通过会话ID找到会话；浏览器断开后会话继续保留，直到 shell 退出或超过保留时长
 	sshSessionsMutex.Lock()
-	sshSessions[sessionID] = sshSession
+	sshSessions[sshSession.ID] = sshSession
 	sshSessionsMutex.Unlock()
 
-	// 发送连接成功消息
-	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("WebShell连接成功 - %s\r\n", config.SSHHost)))
+	owner := newWebShellClient(conn, user, true, false, "")
+	sshSession.attach(owner)
+	defer sshSession.detach(owner)
 
-	// 启动数据转发
-	go handleSSHOutput(sshSession, conn)
-	handleWebSocketInput(sshSession, conn)
+	// 发送连接成功消息，不写入保留的输出
+	owner.send(websocket.BinaryMessage, []byte(fmt.Sprintf("WebShell连接成功 - %s\r\n", config.SSHHost)))
+	if sshSession.recorder != nil {
+		owner.send(websocket.BinaryMessage, []byte("本会话正在录像\r\n"))
+	}
 
-	// 清理会话
-	sshSessionsMutex.Lock()
-	delete(sshSessions, sessionID)
-	sshSessionsMutex.Unlock()
+	// 启动数据转发
+	handleSSHOutput(sshSession)
+	handleWebSocketInput(sshSession, owner)
 }
 
 // 创建SSH会话
-func createSSHSession(config *CSMPDevice, wsConn *websocket.Conn) (*SSHSession, error) {
-	if config.SSHPort == "" {
-		config.SSHPort = "22"
-	}
-
-	// SSH认证方法
-	authMethods := []ssh.AuthMethod{
-		ssh.Password(config.SSHPass),
-		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-			answers := make([]string, len(questions))
-			for i := range answers {
-				answers[i] = config.SSHPass
-			}
-			return answers, nil
-		}),
-	}
-
-	// SSH客户端配置
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUser,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-
-	// 连接SSH服务器
-	address := fmt.Sprintf("%s:%s", config.SSHHost, config.SSHPort)
-	client, err := ssh.Dial("tcp", address, sshConfig)
+func createSSHSession(config *CSMPDevice, cols, rows int) (*SSHSession, error) {
+	id, err := randomToken(8)
 	if err != nil {
-		return nil, fmt.Errorf("SSH连接失败: %v", err)
+		return nil, err
 	}
 
-	// 创建SSH会话
-	session, err := client.NewSession()
+	// 在设备的池化连接上创建SSH会话
+	session, release, err := sshClients.Session(config)
 	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("创建SSH会话失败: %v", err)
+		return nil, fmt.Errorf("SSH连接失败: %w", err)
 	}
 
-	// 设置终端模式（减少控制序列和回显问题）
+	// 设置终端模式，回显由远端处理，浏览器终端只负责显示
 	modes := ssh.TerminalModes{
-		ssh.ECHO:          0, // 禁用回显，避免双重显示
+		ssh.ECHO:          1,
 		ssh.TTY_OP_ISPEED: 14400,
 		ssh.TTY_OP_OSPEED: 14400,
-		ssh.ICANON:        1,
-		ssh.ISIG:          1,
-		ssh.ICRNL:         1,
-		ssh.OPOST:         1,
 		ssh.VERASE:        127, // 设置删除键为DEL (0x7F)
-		ssh.VKILL:         21,  // Ctrl+U
-		ssh.VEOF:          4,   // Ctrl+D
-		ssh.VINTR:         3,   // Ctrl+C
-		ssh.VQUIT:         28,  // Ctrl+\
-		ssh.VSTART:        17,  // Ctrl+Q
-		ssh.VSTOP:         19,  // Ctrl+S
 	}
 
-	// 请求PTY（伪终端）- 使用简单的终端类型减少控制序列
-	if err := session.RequestPty("dumb", 80, 24, modes); err != nil {
-		session.Close()
-		client.Close()
+	// 请求PTY（伪终端），xterm.js 支持完整的 xterm 控制序列，全屏程序可以正常使用
+	if err := session.RequestPty(webShellTerm, rows, cols, modes); err != nil {
+		release()
 		return nil, fmt.Errorf("请求伪终端失败: %v", err)
 	}
 
 	// 获取输入输出管道
 	stdinPipe, err := session.StdinPipe()
 	if err != nil {
-		session.Close()
-		client.Close()
+		release()
 		return nil, fmt.Errorf("获取输入管道失败: %v", err)
 	}
 
 	stdoutPipe, err := session.StdoutPipe()
 	if err != nil {
 		stdinPipe.Close()
-		session.Close()
-		client.Close()
+		release()
 		return nil, fmt.Errorf("获取输出管道失败: %v", err)
 	}
 
 	stderrPipe, err := session.StderrPipe()
 	if err != nil {
 		stdinPipe.Close()
-		session.Close()
-		client.Close()
+		release()
 		return nil, fmt.Errorf("获取错误输出管道失败: %v", err)
 	}
 
-	// 设置环境变量来减少控制序列
-	session.Setenv("TERM", "dumb")              // 使用简单终端类型
-	session.Setenv("PS1", "$ ")                 // 简单的提示符
-	session.Setenv("COLORTERM", "")             // 禁用颜色
-	session.Setenv("HISTCONTROL", "ignoredups") // 历史命令去重
-	session.Setenv("PAGER", "cat")              // 禁用分页器
-	session.Setenv("EDITOR", "nano")            // 设置简单编辑器
-
 	// 启动shell
 	if err := session.Shell(); err != nil {
 		stdinPipe.Close()
-		session.Close()
-		client.Close()
+		release()
 		return nil, fmt.Errorf("启动shell失败: %v", err)
 	}
 
 	return &SSHSession{
-		Client:        client,
-		Session:       session,
-		StdinPipe:     stdinPipe,
-		StdoutPipe:    stdoutPipe,
-		StderrPipe:    stderrPipe,
-		Config:        config,
-		CreatedAt:     time.Now(),
-		LastUsed:      time.Now(),
-		isActive:      true,
-		WebSocketConn: wsConn,
+		ID:         id,
+		Session:    session,
+		StdinPipe:  stdinPipe,
+		StdoutPipe: stdoutPipe,
+		StderrPipe: stderrPipe,
+		Config:     config,
+		CreatedAt:  time.Now(),
+		LastUsed:   time.Now(),
+		isActive:   true,
+		release:    release,
+		Cols:       cols,
+		Rows:       rows,
+		clients:    make(map[string]*webShellClient),
+		shares:     make(map[string]*webShellShare),
+		kicked:     make(map[int]bool),
+		scrollback: newScrollbackBuffer(webShellScrollback),
 	}, nil
 }
 
-// 处理SSH输出并转发到WebSocket
-func handleSSHOutput(sshSession *SSHSession, wsConn *websocket.Conn) {
-	// 处理stdout
-	go func() {
-		buffer := make([]byte, 1024)
+// 处理SSH输出并转发给所有连接的浏览器，shell 退出后结束会话
+func handleSSHOutput(sshSession *SSHSession) {
+	var wg sync.WaitGroup
+	forward := func(name string, pipe io.Reader) {
+		defer wg.Done()
+		record := sshSession.recorder.Output()
+		buffer := make([]byte, 32*1024)
 		for sshSession.isActive {
-			n, err := sshSession.StdoutPipe.Read(buffer)
+			n, err := pipe.Read(buffer)
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("读取SSH stdout失败: %v", err)
+					log.Printf("读取SSH %s失败: %v", name, err)
 				}
 				break
 			}
 			if n > 0 {
-				// 添加小的延迟避免消息过于频繁
-				time.Sleep(10 * time.Millisecond)
-				if err := wsConn.WriteMessage(websocket.TextMessage, buffer[:n]); err != nil {
-					log.Printf("发送WebSocket消息失败: %v", err)
-					break
-				}
+				sshSession.output(buffer[:n])
+				record.Write(buffer[:n])
 			}
 		}
-	}()
-
-	// 处理stderr
+	}
+	wg.Add(2)
+	go forward("stdout", sshSession.StdoutPipe)
+	go forward("stderr", sshSession.StderrPipe)
 	go func() {
-		buffer := make([]byte, 1024)
-		for sshSession.isActive {
-			n, err := sshSession.StderrPipe.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("读取SSH stderr失败: %v", err)
-				}
-				break
-			}
-			if n > 0 {
-				// 添加小的延迟避免消息过于频繁
-				time.Sleep(10 * time.Millisecond)
-				if err := wsConn.WriteMessage(websocket.TextMessage, buffer[:n]); err != nil {
-					log.Printf("发送WebSocket错误消息失败: %v", err)
-					break
-				}
-			}
-		}
+		wg.Wait()
+		closeSSHSession(sshSession)
 	}()
 }
 
-// 处理WebSocket输入并转发到SSH
-func handleWebSocketInput(sshSession *SSHSession, wsConn *websocket.Conn) {
+// 处理浏览器输入并转发到SSH，只读参与者的输入被忽略，窗口大小以所有者为准
+func handleWebSocketInput(sshSession *SSHSession, client *webShellClient) {
+	record := sshSession.recorder.Input()
 	for sshSession.isActive {
-		_, message, err := wsConn.ReadMessage()
+		_, message, err := client.ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket读取错误: %v", err)
@@ -289,143 +323,81 @@ func handleWebSocketInput(sshSession *SSHSession, wsConn *websocket.Conn) {
 
 		sshSession.LastUsed = time.Now()
 
-		// 将WebSocket消息转发到SSH输入
-		if _, err := sshSession.StdinPipe.Write(message); err != nil {
-			log.Printf("写入SSH stdin失败: %v", err)
-			break
+		var msg webShellMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Printf("WebShell消息格式错误: %v", err)
+			continue
+		}
+		switch msg.Type {
+		case webShellData:
+			if client.ReadOnly {
+				continue
+			}
+			// 将输入转发到SSH
+			if _, err := io.WriteString(sshSession.StdinPipe, msg.Data); err != nil {
+				log.Printf("写入SSH stdin失败: %v", err)
+				return
+			}
+			record.Write([]byte(msg.Data))
+		case webShellResize:
+			if !client.Owner {
+				continue
+			}
+			sshSession.resize(clampTermSize(msg.Cols, msg.Rows))
+		case webShellClose:
+			if client.Owner {
+				closeSSHSession(sshSession)
+				return
+			}
+		case webShellPing:
+			if err := client.sendMessage(webShellMessage{Type: webShellPong}); err != nil {
+				return
+			}
 		}
 	}
 }
 
-// 关闭SSH会话
-func closeSSHSession(sshSession *SSHSession) {
-	if sshSession == nil {
+// 调整终端大小，参与者的终端跟随所有者的窗口大小
+func (s *SSHSession) resize(cols, rows int) {
+	if cols == s.Cols && rows == s.Rows {
 		return
 	}
-
-	sshSession.isActive = false
-
-	if sshSession.StdinPipe != nil {
-		sshSession.StdinPipe.Close()
-	}
-	if sshSession.Session != nil {
-		sshSession.Session.Close()
-	}
-	if sshSession.Client != nil {
-		sshSession.Client.Close()
+	if err := s.Session.WindowChange(rows, cols); err != nil {
+		log.Printf("调整终端大小失败: %v", err)
+		return
 	}
+	s.Cols, s.Rows = cols, rows
+	s.recorder.Resize(cols, rows)
+	s.broadcastMessage(webShellMessage{Type: webShellResize, Cols: cols, Rows: rows})
 }
 
-func executeCommand(c *gin.Context) {
-	var req ExecuteRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// 关闭SSH会话，断开所有浏览器连接
+func closeSSHSession(sshSession *SSHSession) {
+	if sshSession == nil {
 		return
 	}
+	sshSession.closeOnce.Do(func() {
+		sshSession.isActive = false
 
-	var config *CSMPDevice
-	for _, cfg := range csmpDevices {
-		if cfg.ID == req.ConfigID {
-			config = &cfg
-			break
+		sshSessionsMutex.Lock()
+		delete(sshSessions, sshSession.ID)
+		sshSessionsMutex.Unlock()
+		sshSession.mu.Lock()
+		if sshSession.graceTimer != nil {
+			sshSession.graceTimer.Stop()
 		}
-	}
-
-	if config == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "配置未找到"})
-		return
-	}
+		sshSession.mu.Unlock()
 
-	// SSH连接并执行命令
-	result, err := executeSSHCommand(config, req.Command)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "命令执行失败: " + err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"item_id": req.ItemID,
-		"command": req.Command,
-		"result":  result,
-		"status":  "success",
-	})
-}
-
-func executeSSHCommand(config *CSMPDevice, command string) (string, error) {
-	// 验证SSH配置
-	if config.SSHHost == "" {
-		return "", fmt.Errorf("SSH主机地址不能为空")
-	}
-	if config.SSHUser == "" {
-		return "", fmt.Errorf("SSH用户名不能为空")
-	}
-	if config.SSHPass == "" {
-		return "", fmt.Errorf("SSH密码不能为空")
-	}
-	if config.SSHPort == "" {
-		config.SSHPort = "22" // 默认端口
-	}
-
-	// 准备多种认证方法
-	authMethods := []ssh.AuthMethod{
-		ssh.Password(config.SSHPass),
-	}
-
-	// 如果可能，添加键盘交互认证
-	authMethods = append(authMethods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-		answers := make([]string, len(questions))
-		for i := range answers {
-			answers[i] = config.SSHPass
+		if sshSession.StdinPipe != nil {
+			sshSession.StdinPipe.Close()
 		}
-		return answers, nil
-	}))
-
-	// SSH连接配置
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUser,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-
-	// 构建连接地址
-	address := config.SSHHost + ":" + config.SSHPort
-
-	// 连接SSH
-	conn, err := ssh.Dial("tcp", address, sshConfig)
-	if err != nil {
-		return "", fmt.Errorf("SSH连接失败 (%s): %v", address, err)
-	}
-	defer conn.Close()
-
-	// 创建会话
-	session, err := conn.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("创建SSH会话失败: %v", err)
-	}
-	defer session.Close()
-
-	// 设置会话模式
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // disable echoing
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
-
-	// 请求伪终端（对某些命令可能需要）
-	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		// 如果无法获取PTY，继续执行（某些命令不需要PTY）
-	}
-
-	// 执行命令
-	output, err := session.Output(command)
-	if err != nil {
-		// 如果命令执行失败，尝试获取错误输出
-		if exitError, ok := err.(*ssh.ExitError); ok {
-			return string(output), fmt.Errorf("命令执行失败 (退出码: %d): %s", exitError.ExitStatus(), string(output))
+		if sshSession.release != nil {
+			sshSession.release()
 		}
-		return string(output), fmt.Errorf("命令执行失败: %v", err)
-	}
-
-	return string(output), nil
-}
\ No newline at end of file
+		for _, client := range sshSession.participants() {
+			client.close("会话已结束")
+		}
+		sshSession.recorder.Close()
+		sshSession.audit(AuditWebShellDisconnect, "会话 "+sshSession.ID+" 时长 "+time.Since(sshSession.CreatedAt).Round(time.Second).String())
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 是否录制 WebShell 会话以及是否录制输入，在 main 中根据启动参数设置
+var (
+	recordWebShell      bool
+	recordWebShellInput bool
+)
+
+// asciicast v2 文件头
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// 以 asciicast v2 格式录制 WebShell 会话：首行为文件头，之后每行一个 [秒数, 类型, 数据] 事件
+type castRecorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	rec   Recording
+	start time.Time
+	size  int64
+	// 各数据流，关闭时写出其中未完成的字符
+	streams []*castStream
+}
+
+// 开始录制 WebShell 会话，未开启录制或创建文件失败时返回 nil，不影响会话本身
+func startWebShellRecording(c *gin.Context, dev *CSMPDevice, width, height int, term string) *castRecorder {
+	if !recordWebShell {
+		return nil
+	}
+	user := currentUser(c)
+	f, rec, err := recordings.Create(Recording{
+		Kind:     RecordingWebShell,
+		DeviceID: dev.ID,
+		UserID:   user.ID,
+		User:     user.Username,
+	})
+	if err != nil {
+		log.Printf("创建 WebShell 录像失败: %v", err)
+		return nil
+	}
+	r := &castRecorder{file: f, w: bufio.NewWriter(f), rec: rec, start: time.Now()}
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: rec.StartedAt.Unix(),
+		Title:     user.Username + "@" + dev.SSHHost,
+		Env:       map[string]string{"TERM": term},
+	})
+	r.writeLine(header)
+	return r
+}
+
+// 写入一行，写入失败时停止录制，调用方需持有锁
+func (r *castRecorder) writeLine(line []byte) {
+	if r.w == nil {
+		return
+	}
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		log.Printf("写入 WebShell 录像 %s 失败: %v", r.rec.ID, err)
+		r.w = nil
+		return
+	}
+	r.size += int64(len(line) + 1)
+}
+
+func (r *castRecorder) event(kind, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eventLocked(kind, data)
+}
+
+// 调用方需持有锁
+func (r *castRecorder) eventLocked(kind, data string) {
+	line, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, data})
+	r.writeLine(line)
+}
+
+// 某一方向的数据流；读取可能在多字节字符中间截断，不完整的尾部留到下次一起写入，
+// pending 由录像的锁保护
+type castStream struct {
+	r       *castRecorder
+	kind    string
+	pending []byte
+}
+
+func (r *castRecorder) stream(kind string) *castStream {
+	s := &castStream{r: r, kind: kind}
+	r.mu.Lock()
+	r.streams = append(r.streams, s)
+	r.mu.Unlock()
+	return s
+}
+
+// 输出流，stdout 和 stderr 各用一个
+func (r *castRecorder) Output() *castStream {
+	if r == nil {
+		return nil
+	}
+	return r.stream("o")
+}
+
+// 输入流，未开启输入录制时返回 nil
+func (r *castRecorder) Input() *castStream {
+	if r == nil || !recordWebShellInput {
+		return nil
+	}
+	return r.stream("i")
+}
+
+// buf 开头完整字符部分的长度，末尾最多 3 个字节可能属于未读完的字符
+func utf8CompleteLen(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-3; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(buf)
+}
+
+func (s *castStream) Write(data []byte) {
+	if s == nil {
+		return
+	}
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	buf := append(s.pending, data...)
+	cut := utf8CompleteLen(buf)
+	s.pending = append([]byte(nil), buf[cut:]...)
+	if cut > 0 {
+		s.r.eventLocked(s.kind, string(buf[:cut]))
+	}
+}
+
+// 记录终端窗口大小变化
+func (r *castRecorder) Resize(cols, rows int) {
+	if r == nil {
+		return
+	}
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *castRecorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 会话结束时不会再有后续字节，未完成的字符原样写出
+	for _, s := range r.streams {
+		if len(s.pending) > 0 {
+			r.eventLocked(s.kind, string(s.pending))
+			s.pending = nil
+		}
+	}
+	if r.w != nil {
+		r.w.Flush()
+		r.w = nil
+	}
+	r.file.Close()
+	if err := recordings.Finish(r.rec, r.size); err != nil {
+		log.Printf("保存 WebShell 录像 %s 失败: %v", r.rec.ID, err)
+	}
+}
+
+// 在 asciicast 录像的输入输出中查找文本，忽略大小写
+func castContains(path, q string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	q = strings.ToLower(q)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	// 关键字可能跨越两个事件，保留上一事件的末尾一起匹配
+	var tail string
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			continue
+		}
+		var ev []interface{}
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil || len(ev) < 3 {
+			continue
+		}
+		if kind, _ := ev[1].(string); kind != "o" && kind != "i" {
+			continue
+		}
+		data, _ := ev[2].(string)
+		text := tail + strings.ToLower(data)
+		if strings.Contains(text, q) {
+			return true, nil
+		}
+		if len(text) > len(q) {
+			tail = text[len(text)-len(q):]
+		} else {
+			tail = text
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 所有者断开后会话保留的时长和保留的最近输出大小，在 main 中根据启动参数设置
+var (
+	webShellGrace      = 5 * time.Minute
+	webShellScrollback = 256 * 1024
+)
+
+// 保留最近输出的环形缓冲区，重新连接时回放
+type scrollbackBuffer struct {
+	data []byte
+	pos  int
+	full bool
+}
+
+func newScrollbackBuffer(size int) *scrollbackBuffer {
+	return &scrollbackBuffer{data: make([]byte, max(size, 0))}
+}
+
+func (b *scrollbackBuffer) Write(p []byte) {
+	size := len(b.data)
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		copy(b.data, p[len(p)-size:])
+		b.pos, b.full = 0, true
+		return
+	}
+	n := copy(b.data[b.pos:], p)
+	if n < len(p) {
+		copy(b.data, p[n:])
+	}
+	// 恰好写到末尾时 pos 回到 0，同样算写满
+	if b.pos+len(p) >= size {
+		b.full = true
+	}
+	b.pos = (b.pos + len(p)) % size
+}
+
+// 缓冲区中的内容；写满后从第一个换行之后开始，避免回放从半个字符或控制序列开始
+func (b *scrollbackBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.data[:b.pos]...)
+	}
+	out := append(append([]byte(nil), b.data[b.pos:]...), b.data[:b.pos]...)
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	return out
+}
+
+// 所有者的浏览器全部断开后开始计时，超时仍未恢复则结束会话；调用方需持有 s.mu
+func (s *SSHSession) scheduleCloseLocked() {
+	for _, cl := range s.clients {
+		if cl.Owner {
+			return
+		}
+	}
+	if webShellGrace <= 0 {
+		go closeSSHSession(s)
+		return
+	}
+	s.DetachedAt = time.Now()
+	s.graceTimer = time.AfterFunc(webShellGrace, func() { closeSSHSession(s) })
+	s.audit(AuditWebShellDetach, "会话 "+s.ID+" 保留 "+webShellGrace.String())
+}
+
+// 会话结束等不在请求中发生的事件以会话所有者的名义记入审计
+func (s *SSHSession) audit(action, detail string) {
+	if audit == nil {
+		return
+	}
+	err := audit.Append(AuditEntry{
+		Actor:    s.Owner,
+		ActorID:  s.OwnerID,
+		SourceIP: s.ownerIP,
+		Action:   action,
+		DeviceID: s.Config.ID,
+		Outcome:  AuditSuccess,
+		Detail:   detail,
+	})
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// 所有者按会话ID重新连接，回放保留的输出后继续会话
+func resumeWebShell(c *gin.Context, id string) {
+	sshSession, ok := findWebShellSession(id)
+	if !ok || !sshSession.isActive {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在或已结束"})
+		return
+	}
+	user := currentUser(c)
+	if user.ID != sshSession.OwnerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只能恢复自己的会话"})
+		return
+	}
+	config := sshSession.Config
+	if !checkDeviceAction(c, config, ActionWebShell) {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket升级失败: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	sshSession.ownerIP = c.ClientIP()
+	recordAudit(c, AuditWebShellResume, config.ID, "", AuditSuccess, "会话 "+sshSession.ID)
+
+	// 按新页面的窗口大小调整终端，全屏程序会随之重绘
+	if cols, err := strconv.Atoi(c.Query("cols")); err == nil {
+		rows, _ := strconv.Atoi(c.Query("rows"))
+		sshSession.resize(clampTermSize(cols, rows))
+	}
+
+	client := newWebShellClient(conn, user, true, false, "")
+	sshSession.attach(client)
+	defer sshSession.detach(client)
+	handleWebSocketInput(sshSession, client)
+}
+
+// 当前用户的 WebShell 会话，管理员可以看到所有会话
+func listWebShellSessions(c *gin.Context) {
+	user := currentUser(c)
+	sshSessionsMutex.RLock()
+	list := make([]gin.H, 0, len(sshSessions))
+	for _, s := range sshSessions {
+		if s.OwnerID != user.ID && !roleAtLeast(user.Role, RoleAdmin) {
+			continue
+		}
+		s.mu.Lock()
+		item := gin.H{
+			"id":           s.ID,
+			"device_id":    s.Config.ID,
+			"device":       s.Config.Name,
+			"owner":        s.Owner,
+			"created_at":   s.CreatedAt,
+			"participants": len(s.clients),
+		}
+		if s.graceTimer != nil {
+			item["detached_at"] = s.DetachedAt
+		}
+		s.mu.Unlock()
+		list = append(list, item)
+	}
+	sshSessionsMutex.RUnlock()
+	c.JSON(http.StatusOK, list)
+}
+
+// 结束会话，所有者关闭页面时使用，不再保留
+func closeWebShellSession(c *gin.Context) {
+	sshSession, ok := ownedWebShellSession(c)
+	if !ok {
+		return
+	}
+	closeSSHSession(sshSession)
+	c.JSON(http.StatusOK, gin.H{"message": "会话已结束"})
+}
+
+// 会话输出：写入保留缓冲区并发送给所有参与者
+func (s *SSHSession) output(data []byte) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.scrollback.Write(data)
+	s.broadcast(websocket.BinaryMessage, data)
+}
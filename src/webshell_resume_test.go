@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestScrollbackBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{name: "未写满", size: 8, writes: []string{"ab", "cd"}, want: "abcd"},
+		{name: "恰好写满", size: 8, writes: []string{"abcd", "efgh"}, want: "abcdefgh"},
+		{name: "一次写满", size: 4, writes: []string{"abcd"}, want: "abcd"},
+		{name: "回绕", size: 8, writes: []string{"abcdef", "ghij"}, want: "cdefghij"},
+		{name: "恰好写满后继续写", size: 4, writes: []string{"abcd", "ef"}, want: "cdef"},
+		{name: "超过容量", size: 4, writes: []string{"ab", "cdefgh"}, want: "efgh"},
+		{name: "写满后从换行之后回放", size: 8, writes: []string{"abc\ndefgh"}, want: "defgh"},
+		{name: "容量为零", size: 0, writes: []string{"abc"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newScrollbackBuffer(tt.size)
+			for _, w := range tt.writes {
+				b.Write([]byte(w))
+			}
+			if got := string(b.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 连接到 WebShell 会话的一个浏览器
+type webShellClient struct {
+	ID       string    `json:"id"`
+	UserID   int       `json:"user_id"`
+	User     string    `json:"user"`
+	Owner    bool      `json:"owner"`
+	ReadOnly bool      `json:"read_only"`
+	JoinedAt time.Time `json:"joined_at"`
+	share    string    // 加入时使用的共享链接，所有者为空
+	ws       *websocket.Conn
+	writeMu  sync.Mutex // websocket 不支持并发写
+}
+
+// 共享链接，持有链接且有设备 WebShell 权限的用户可以加入会话
+type webShellShare struct {
+	Token     string    `json:"token"`
+	ReadOnly  bool      `json:"read_only"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+}
+
+// 关闭连接时告知浏览器原因的超时
+const webShellCloseTimeout = 5 * time.Second
+
+func newWebShellClient(ws *websocket.Conn, user *User, owner, readOnly bool, share string) *webShellClient {
+	id, _ := randomToken(4)
+	return &webShellClient{
+		ID:       id,
+		UserID:   user.ID,
+		User:     user.Username,
+		Owner:    owner,
+		ReadOnly: readOnly,
+		JoinedAt: time.Now(),
+		share:    share,
+		ws:       ws,
+	}
+}
+
+func (cl *webShellClient) send(messageType int, data []byte) error {
+	cl.writeMu.Lock()
+	defer cl.writeMu.Unlock()
+	return cl.ws.WriteMessage(messageType, data)
+}
+
+func (cl *webShellClient) sendMessage(msg webShellMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return cl.send(websocket.TextMessage, data)
+}
+
+// 以正常关闭帧断开连接，浏览器可以显示原因
+func (cl *webShellClient) close(reason string) {
+	cl.writeMu.Lock()
+	cl.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(webShellCloseTimeout))
+	cl.writeMu.Unlock()
+	cl.ws.Close()
+}
+
+// 加入会话，告知该浏览器会话信息并回放保留的输出，然后通知所有参与者
+func (s *SSHSession) attach(cl *webShellClient) {
+	// 回放和加入期间暂停输出，保证浏览器收到的内容不重复也不缺失
+	s.outMu.Lock()
+	cl.sendMessage(webShellMessage{
+		Type:      webShellSession,
+		SessionID: s.ID,
+		ClientID:  cl.ID,
+		Owner:     cl.Owner,
+		ReadOnly:  cl.ReadOnly,
+		Device:    s.Config.Name,
+		Cols:      s.Cols,
+		Rows:      s.Rows,
+	})
+	if data := s.scrollback.Bytes(); len(data) > 0 {
+		cl.send(websocket.BinaryMessage, data)
+	}
+	s.mu.Lock()
+	s.clients[cl.ID] = cl
+	if cl.Owner && s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+	s.mu.Unlock()
+	s.outMu.Unlock()
+	s.notifyParticipants()
+}
+
+// 离开会话，所有者全部断开后会话保留一段时间等待恢复
+func (s *SSHSession) detach(cl *webShellClient) {
+	s.mu.Lock()
+	delete(s.clients, cl.ID)
+	if cl.Owner && s.isActive {
+		s.scheduleCloseLocked()
+	}
+	s.mu.Unlock()
+	s.notifyParticipants()
+}
+
+// 按加入时间排列的参与者
+func (s *SSHSession) participants() []*webShellClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*webShellClient, 0, len(s.clients))
+	for _, cl := range s.clients {
+		list = append(list, cl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].JoinedAt.Before(list[j].JoinedAt) })
+	return list
+}
+
+// 发送给所有参与者，发送失败的连接被断开，不影响其他参与者
+func (s *SSHSession) broadcast(messageType int, data []byte) {
+	for _, cl := range s.participants() {
+		if err := cl.send(messageType, data); err != nil {
+			log.Printf("发送WebSocket消息失败: %v", err)
+			cl.ws.Close()
+		}
+	}
+}
+
+func (s *SSHSession) broadcastMessage(msg webShellMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.broadcast(websocket.TextMessage, data)
+}
+
+func (s *SSHSession) notifyParticipants() {
+	s.broadcastMessage(webShellMessage{Type: webShellParticipants, Participants: s.participants()})
+}
+
+func (s *SSHSession) createShare(readOnly bool) (*webShellShare, error) {
+	token, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	share := &webShellShare{
+		Token:     token,
+		ReadOnly:  readOnly,
+		CreatedAt: time.Now(),
+		URL:       "/api/webshell?share=" + token,
+	}
+	s.mu.Lock()
+	s.shares[token] = share
+	s.mu.Unlock()
+	return share, nil
+}
+
+func (s *SSHSession) listShares() []*webShellShare {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*webShellShare, 0, len(s.shares))
+	for _, share := range s.shares {
+		list = append(list, share)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// 撤销共享链接，并断开通过该链接加入的参与者
+func (s *SSHSession) revokeShare(token string) bool {
+	s.mu.Lock()
+	_, ok := s.shares[token]
+	delete(s.shares, token)
+	var kicked []*webShellClient
+	for _, cl := range s.clients {
+		if ok && cl.share == token {
+			kicked = append(kicked, cl)
+		}
+	}
+	s.mu.Unlock()
+	for _, cl := range kicked {
+		cl.close("共享已被撤销")
+	}
+	return ok
+}
+
+// 移除一个参与者及该用户的其他共享连接，之后该用户不能再加入，所有者不能被移除
+func (s *SSHSession) kick(clientID string) bool {
+	s.mu.Lock()
+	cl, ok := s.clients[clientID]
+	if !ok || cl.Owner {
+		s.mu.Unlock()
+		return false
+	}
+	s.kicked[cl.UserID] = true
+	var kicked []*webShellClient
+	for _, other := range s.clients {
+		if !other.Owner && other.UserID == cl.UserID {
+			kicked = append(kicked, other)
+		}
+	}
+	s.mu.Unlock()
+	for _, cl := range kicked {
+		cl.close("已被会话所有者移出")
+	}
+	return true
+}
+
+func (s *SSHSession) isKicked(userID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kicked[userID]
+}
+
+func findWebShellSession(id string) (*SSHSession, bool) {
+	sshSessionsMutex.RLock()
+	defer sshSessionsMutex.RUnlock()
+	s, ok := sshSessions[id]
+	return s, ok
+}
+
+// 按共享链接查找会话
+func findSharedWebShell(token string) (*SSHSession, *webShellShare, bool) {
+	sshSessionsMutex.RLock()
+	defer sshSessionsMutex.RUnlock()
+	for _, s := range sshSessions {
+		s.mu.Lock()
+		share, ok := s.shares[token]
+		s.mu.Unlock()
+		if ok {
+			return s, share, true
+		}
+	}
+	return nil, nil, false
+}
+
+// 通过共享链接加入会话，加入者同样需要设备的 WebShell 权限
+func attachSharedWebShell(c *gin.Context, token string) {
+	sshSession, share, ok := findSharedWebShell(token)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "共享链接无效或已撤销"})
+		return
+	}
+	config := sshSession.Config
+	if !checkDeviceAction(c, config, ActionWebShell) {
+		return
+	}
+	if sshSession.isKicked(currentUser(c).ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "已被会话所有者移出，不能再加入"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket升级失败: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := newWebShellClient(conn, currentUser(c), false, share.ReadOnly, token)
+	detail := "加入 " + sshSession.Owner + " 的会话 " + sshSession.ID
+	if client.ReadOnly {
+		detail += " 只读"
+	}
+	recordAudit(c, AuditWebShellAttach, config.ID, "", AuditSuccess, detail)
+	connectedAt := time.Now()
+	defer func() {
+		recordAudit(c, AuditWebShellDisconnect, config.ID, "", AuditSuccess, "会话 "+sshSession.ID+" 时长 "+time.Since(connectedAt).Round(time.Second).String())
+	}()
+
+	sshSession.attach(client)
+	defer sshSession.detach(client)
+	client.send(websocket.BinaryMessage, []byte("已加入 "+sshSession.Owner+" 的WebShell会话 - "+config.SSHHost+"\r\n"))
+	if sshSession.recorder != nil {
+		client.send(websocket.BinaryMessage, []byte("本会话正在录像\r\n"))
+	}
+	handleWebSocketInput(sshSession, client)
+}
+
+// 会话所有者（或管理员）才能管理共享
+func ownedWebShellSession(c *gin.Context) (*SSHSession, bool) {
+	sshSession, ok := findWebShellSession(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return nil, false
+	}
+	user := currentUser(c)
+	if user.ID != sshSession.OwnerID && !roleAtLeast(user.Role, RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有会话所有者可以管理共享"})
+		return nil, false
+	}
+	return sshSession, true
+}
+
+// WebShell 会话共享接口
+func getWebShellSession(c *gin.Context) {
+	sshSession, ok := ownedWebShellSession(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":           sshSession.ID,
+		"device_id":    sshSession.Config.ID,
+		"owner":        sshSession.Owner,
+		"created_at":   sshSession.CreatedAt,
+		"participants": sshSession.participants(),
+		"shares":       sshSession.listShares(),
+	})
+}
+
+func createWebShellShare(c *gin.Context) {
+	sshSession, ok := ownedWebShellSession(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	share, err := sshSession.createShare(req.ReadOnly)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	detail := "会话 " + sshSession.ID
+	if share.ReadOnly {
+		detail += " 只读"
+	}
+	recordAudit(c, AuditWebShellShare, sshSession.Config.ID, "", AuditSuccess, detail)
+	c.JSON(http.StatusCreated, share)
+}
+
+func revokeWebShellShare(c *gin.Context) {
+	sshSession, ok := ownedWebShellSession(c)
+	if !ok {
+		return
+	}
+	if !sshSession.revokeShare(c.Param("token")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "共享链接不存在"})
+		return
+	}
+	recordAudit(c, AuditWebShellRevoke, sshSession.Config.ID, "", AuditSuccess, "会话 "+sshSession.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "共享已撤销"})
+}
+
+func kickWebShellParticipant(c *gin.Context) {
+	sshSession, ok := ownedWebShellSession(c)
+	if !ok {
+		return
+	}
+	if !sshSession.kick(c.Param("client")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "参与者不存在"})
+		return
+	}
+	recordAudit(c, AuditWebShellRevoke, sshSession.Config.ID, "", AuditSuccess, "会话 "+sshSession.ID+" 移出参与者 "+c.Param("client"))
+	c.JSON(http.StatusOK, gin.H{"message": "参与者已移出"})
+}
@@ -14,9 +14,104 @@ class ICPlatform {
 
     async init() {
         this.setupEventListeners();
+        await this.loadCurrentUser();
         await this.loadConfigs();
     }
 
+    // 封装 fetch，登录失效时跳转到登录页
+    async request(url, options = {}) {
+        const response = await fetch(url, options);
+        if (response.status === 401) {
+            window.location.href = '/login?next=' + encodeURIComponent(window.location.pathname);
+            throw new Error('未登录');
+        }
+        return response;
+    }
+
+    async loadCurrentUser() {
+        try {
+            const response = await this.request('/api/auth/me');
+            this.user = await response.json();
+            document.getElementById('current-user').textContent = `${this.user.username} (${this.user.role})`;
+            // 只有管理员可以编辑设备配置
+            if (this.user.role !== 'admin') {
+                document.querySelector('[data-menu="configs"]').style.display = 'none';
+                document.getElementById('recordings-button').style.display = 'none';
+            }
+            if (this.user.role === 'viewer') {
+                document.getElementById('batch-button').style.display = 'none';
+                document.getElementById('runbook-button').style.display = 'none';
+                document.getElementById('schedule-button').style.display = 'none';
+                document.getElementById('forward-button').style.display = 'none';
+            }
+        } catch (error) {
+            console.error('获取当前用户失败:', error);
+        }
+    }
+
+    // 两步验证：未启用时绑定，已启用时停用
+    async manageTOTP() {
+        try {
+            const status = await (await this.request('/api/auth/totp')).json();
+            if (status.enabled) {
+                const code = prompt(`两步验证已启用（剩余恢复码 ${status.recovery_codes} 个）。输入验证码或恢复码以停用：`);
+                if (!code) return;
+                const response = await this.postJSON('/api/auth/totp/disable', { code });
+                const result = await response.json();
+                this.showNotification(response.ok ? result.message : result.error, response.ok ? 'success' : 'error');
+                return;
+            }
+
+            const enroll = await (await this.postJSON('/api/auth/totp/enroll', {})).json();
+            const code = prompt('请在验证器应用中添加以下地址（或手动输入密钥 ' + enroll.secret + '），然后输入 6 位验证码：', enroll.uri);
+            if (!code || code === enroll.uri) return;
+            const response = await this.postJSON('/api/auth/totp/confirm', { code });
+            const result = await response.json();
+            if (!response.ok) {
+                this.showNotification(result.error, 'error');
+                return;
+            }
+            alert('两步验证已启用。请妥善保存以下恢复码，每个只能使用一次：\n\n' + result.recovery_codes.join('\n'));
+        } catch (error) {
+            this.showNotification('两步验证设置失败', 'error');
+        }
+    }
+
+    // 敏感操作前完成二次验证，已在有效期内时直接通过
+    async ensureStepUp() {
+        const status = await (await this.request('/api/auth/totp')).json();
+        if (!status.enabled) {
+            this.showNotification('该操作需要两步验证，请先启用 TOTP', 'warning');
+            return false;
+        }
+        if (status.fresh) {
+            return true;
+        }
+        const code = prompt('请输入验证器中的 6 位验证码或恢复码：');
+        if (!code) {
+            return false;
+        }
+        const response = await this.postJSON('/api/auth/step-up', { code });
+        if (!response.ok) {
+            this.showNotification((await response.json()).error, 'error');
+            return false;
+        }
+        return true;
+    }
+
+    postJSON(url, data, method = 'POST') {
+        return this.request(url, {
+            method,
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(data)
+        });
+    }
+
+    async logout() {
+        await fetch('/api/auth/logout', { method: 'POST' });
+        window.location.href = '/login';
+    }
+
     setupEventListeners() {
         // 菜单切换
         document.querySelectorAll('.menu-item').forEach(item => {
@@ -68,6 +163,7 @@ class ICPlatform {
 
         if (config) {
             title.textContent = '编辑配置';
+            form.reset();
             this.fillForm(form, config);
             form.dataset.configId = config.id;
         } else {
@@ -91,15 +187,17 @@ class ICPlatform {
         	if (!input && key.includes('_')) {
             	input = form.querySelector(`[name="${key.replace(/_/g, '-')}"`);
         	}
-            if (input) {
-                input.value = data[key];
+            if (input && input.type === 'checkbox') {
+                input.checked = !!data[key];
+            } else if (input) {
+                input.value = key === 'jump_hosts' ? JSON.stringify(data[key], null, 2) : data[key];
             }
         });
     }
 
     async loadConfigs() {
         try {
-            const response = await fetch('/api/devices');
+            const response = await this.request('/api/devices');
             this.configs = await response.json();
             this.renderConfigs();
             
@@ -124,6 +222,7 @@ class ICPlatform {
                 <h4>${config.name}</h4>
                 <div class="config-actions">
                     <button class="btn btn-outline" onclick="app.editConfig(${config.id})">编辑</button>
+                    <button class="btn btn-outline" onclick="app.manageHostKey(${config.id})">主机密钥</button>
                     <button class="btn btn-danger" onclick="app.deleteConfig(${config.id})">删除</button>
                 </div>
             </div>
@@ -145,6 +244,33 @@ class ICPlatform {
         }
     }
 
+    // 查看设备 SSH 主机密钥，有待确认的密钥时可以接受，否则可以重置
+    async manageHostKey(configId) {
+        try {
+            const data = await (await this.request(`/api/devices/${configId}/hostkey`)).json();
+            const pending = data.hosts.find(h => h.pending_fingerprint);
+            const lines = data.hosts.map(h => `${h.address}\n  已记录: ${h.fingerprint || '无'}` +
+                (h.pending_fingerprint ? `\n  待确认: ${h.pending_fingerprint}` : ''));
+            const summary = `策略: ${data.policy}\n\n${lines.join('\n\n') || '尚未记录主机密钥'}`;
+
+            if (pending) {
+                if (!confirm(`${summary}\n\n请通过其他渠道核实指纹后再接受。确定接受 ${pending.pending_fingerprint} 吗？`)) return;
+                const response = await this.postJSON(`/api/devices/${configId}/hostkey/accept`, { fingerprint: pending.pending_fingerprint });
+                const result = await response.json();
+                this.showNotification(response.ok ? '已接受新的主机密钥' : result.error, response.ok ? 'success' : 'error');
+                return;
+            }
+            if (data.hosts.length > 0 && confirm(`${summary}\n\n确定重置吗？下次连接时将重新记录主机密钥。`)) {
+                await this.request(`/api/devices/${configId}/hostkey`, { method: 'DELETE' });
+                this.showNotification('主机密钥已重置', 'success');
+            } else if (data.hosts.length === 0) {
+                alert(summary);
+            }
+        } catch (error) {
+            this.showNotification('获取主机密钥失败', 'error');
+        }
+    }
+
     async deleteConfig(configId) {
         if (!confirm('确定要删除这个配置吗？')) {
             return;
@@ -152,7 +278,7 @@ class ICPlatform {
 
         try {
             this.showLoading();
-            const response = await fetch(`/api/configs/${configId}`, {
+            const response = await this.request(`/api/devices/${configId}`, {
                 method: 'DELETE'
             });
 
@@ -177,6 +303,14 @@ class ICPlatform {
         const form = document.getElementById('config-form');
         const formData = new FormData(form);
         const data = Object.fromEntries(formData);
+        data.tags = (data.tags || '').split(',').map(t => t.trim()).filter(t => t);
+        data.vnc_via_ssh = form.querySelector('[name="vnc_via_ssh"]').checked;
+        try {
+            data.jump_hosts = data.jump_hosts && data.jump_hosts.trim() ? JSON.parse(data.jump_hosts) : [];
+        } catch (error) {
+            this.showNotification('跳板机配置不是有效的 JSON', 'error');
+            return;
+        }
         
         // 验证URL格式
         const urlFields = ['login_url'];
@@ -201,18 +335,21 @@ class ICPlatform {
         }
         
         const isEdit = form.dataset.configId;
-        const url = isEdit ? `/api/configs/${form.dataset.configId}` : '/api/configs';
+        const url = isEdit ? `/api/devices/${form.dataset.configId}` : '/api/devices';
         const method = isEdit ? 'PUT' : 'POST';
 
         try {
             this.showLoading();
-            const response = await fetch(url, {
-                method,
-                headers: {
-                    'Content-Type': 'application/json'
-                },
-                body: JSON.stringify(data)
-            });
+            let response = await this.postJSON(url, data, method);
+            // 修改凭据需要二次验证时，验证后重试一次
+            if (response.status === 403 && (await response.clone().json()).mfa_required) {
+                this.hideLoading();
+                if (!(await this.ensureStepUp())) {
+                    return;
+                }
+                this.showLoading();
+                response = await this.postJSON(url, data, method);
+            }
 
             if (response.ok) {
                 await this.loadConfigs();
@@ -394,6 +531,9 @@ class ICPlatform {
                     <button class="btn btn-outline webshell-btn" onclick="app.openWebShell(${device.id})" title="打开WebShell">
                         <i class="fas fa-terminal"></i> WebShell
                     </button>
+                    <button class="btn btn-outline webshell-btn" onclick="app.openSFTP(${device.id})" title="浏览和传输文件">
+                        <i class="fas fa-folder-open"></i> 文件
+                    </button>
                 </td>
                 <td>
                     <button class="btn btn-info" onclick="app.jumpToLogin(${device.id})" title="跳转到原始登录页面">
@@ -488,19 +628,30 @@ class ICPlatform {
         }
 
         // 检查SSH配置
-        if (!config.ssh_host || !config.ssh_user || !config.ssh_pass) {
+        const secrets = config.secrets_set || [];
+        const sshReady = {
+            password: secrets.includes('ssh_pass'),
+            key: secrets.includes('ssh_key'),
+            cert: secrets.includes('ssh_key') && !!config.ssh_cert,
+            agent: true,
+        }[config.ssh_auth_type || 'password'];
+        if (!config.ssh_host || !config.ssh_user || !sshReady) {
             this.showNotification('设备SSH配置不完整，请先配置SSH信息', 'warning');
             this.selectDeviceConfig(deviceId);
             return;
         }
 
+        const mfa = await (await this.request('/api/auth/totp')).json();
+        if (mfa.webshell_mfa && !(await this.ensureStepUp())) {
+            return;
+        }
+
         // 构建WebShell URL参数
         const params = new URLSearchParams({
             deviceId: config.id,
             deviceName: device.name,
             host: config.ssh_host,
             user: config.ssh_user,
-            pass: config.ssh_pass,
             port: config.ssh_port || '22'
         });
 
@@ -527,6 +678,20 @@ class ICPlatform {
         }
     }
 
+    // 在新窗口中打开设备的文件浏览器，使用与 WebShell 相同的 SSH 配置
+    openSFTP(deviceId) {
+        const device = this.devices.find(d => d.id === deviceId);
+        if (!device) {
+            this.showNotification('设备不存在', 'error');
+            return;
+        }
+        const params = new URLSearchParams({ deviceId: deviceId, deviceName: device.name });
+        const newWindow = window.open(`/api/sftp?${params.toString()}`, `sftp-${deviceId}`, 'width=1000,height=700,scrollbars=yes,resizable=yes');
+        if (!newWindow) {
+            this.showNotification('无法打开文件窗口,请检查浏览器弹窗设置', 'error');
+        }
+    }
+
     jumpToLogin(configId) {
         const config = this.configs.find(c => c.id === configId);
         if (!config) {
@@ -561,8 +726,8 @@ class ICPlatform {
 		console.log(`打开WebShell`,this.configs);
         console.log(`打开VNC: ${itemName}, 设备ID: ${deviceId}`);
 		const device = this.devices.find(d => d.id === deviceId);
-		let address = '';
-		let pass = '';
+		let token = '';
+		let viewOnly = false;
         if (!device) {
             this.showNotification('设备不存在', 'error');
             return;
@@ -576,7 +741,7 @@ class ICPlatform {
 
         try {
             this.showLoading();
-            const response = await fetch(`/api/vnc/${deviceId}?itemName=${encodeURIComponent(itemName)}`);
+            const response = await this.request(`/api/vnc/${deviceId}?itemName=${encodeURIComponent(itemName)}`);
             if (response.ok) {
                 const data = await response.json();          
                 // 更新整个设备表格
@@ -587,11 +752,12 @@ class ICPlatform {
                 if (detailsRow && detailsRow.classList.contains('show')) {
                     this.toggleDeviceDetails(deviceId);
                 }
-				address = data.address;
-				pass = data.pass;
+				token = data.token;
+				viewOnly = data.view_only;
             } else {
                 const data = await response.json();
                 this.showNotification(data.error || 'VNC打开跳转失败', 'error');
+                return;
             }
         } catch (error) {
             console.error('VNC:', error);
@@ -601,8 +767,8 @@ class ICPlatform {
             this.hideLoading();
         }
 
-        // 在新窗口中打开WebShell
-		const VNCWebshellUrl = `/api/vnc?address=${encodeURIComponent(address)}&pass=${encodeURIComponent(pass)}`;
+        // 在新窗口中打开VNC，一次性票据放在 # 之后，不进入服务器访问日志
+		const VNCWebshellUrl = `/api/vnc?view_only=${viewOnly}#token=${encodeURIComponent(token)}`;
         const windowFeatures = 'width=1050,height=860,scrollbars=yes,resizable=yes,menubar=no,toolbar=no,location=no,status=no';
         
         const newWindow = window.open(VNCWebshellUrl, `webshell-${itemName}`, windowFeatures);
@@ -635,7 +801,7 @@ class ICPlatform {
 
         try {
             this.showLoading();
-            const response = await fetch(`/api/csmp/${deviceId}`);
+            const response = await this.request(`/api/csmp/${deviceId}`);
             if (response.ok) {
                 const data = await response.json();
                 device.data = data;
@@ -654,7 +820,6 @@ class ICPlatform {
                 
                 this.showNotification(`${device.name} 数据刷新成功`, 'success');
             } else {
-                throw new Error('刷新失败');
                 const data = await response.json();
                 this.showNotification(`刷新 ${device.name} 失败: ${data.error}`, 'error');
             }